@@ -0,0 +1,113 @@
+package kevs
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const defaultCacheSize = 64
+
+var parseCache = lruCache{
+	size: defaultCacheSize,
+}
+
+// ParseCached is like Parse but keeps the most recently parsed tables in a
+// cache keyed by a hash of content and flags, so that parsing the same
+// content again is cheap. Callers get their own copy of the cached table
+// and are free to modify it.
+//
+// Flags with an IdentifierFunc, whose behavior can't be part of the key,
+// or with ExpandEnv, whose result depends on the environment, bypass the
+// cache.
+func ParseCached(file, content string, flags Flags) (Table, error) {
+	if flags.IdentifierFunc != nil || flags.ExpandEnv {
+		return Parse(file, content, flags)
+	}
+	key := cache_key(content, flags)
+	if t, ok := parseCache.get(key); ok {
+		return t.Clone(), nil
+	}
+	t, err := Parse(file, content, flags)
+	if err != nil {
+		return nil, err
+	}
+	parseCache.put(key, t.Clone())
+	return t, nil
+}
+
+// SetParseCacheSize sets the maximum number of tables kept by ParseCached,
+// evicting the least recently used ones if needed. Zero disables caching.
+func SetParseCacheSize(n int) {
+	parseCache.resize(n)
+}
+
+// cache_key hashes content and the scalar fields of flags. Func fields are
+// formatted as addresses, which say nothing about their behavior, so they
+// must be nil.
+func cache_key(content string, flags Flags) [sha256.Size]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%+v\x00", flags)
+	_, _ = io.WriteString(h, content)
+	var out [sha256.Size]byte
+	h.Sum(out[:0])
+	return out
+}
+
+type lruEntry struct {
+	key   [sha256.Size]byte
+	table Table
+}
+
+// lruCache is a least recently used cache of parsed tables.
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	order   list.List // front is most recently used
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+func (self *lruCache) get(key [sha256.Size]byte) (Table, bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	e, ok := self.entries[key]
+	if !ok {
+		return nil, false
+	}
+	self.order.MoveToFront(e)
+	return e.Value.(*lruEntry).table, true //nolint:forcetypeassert // only *lruEntry is stored
+}
+
+func (self *lruCache) put(key [sha256.Size]byte, t Table) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.size <= 0 {
+		return
+	}
+	if self.entries == nil {
+		self.entries = make(map[[sha256.Size]byte]*list.Element)
+	}
+	if e, ok := self.entries[key]; ok {
+		self.order.MoveToFront(e)
+		return
+	}
+	self.entries[key] = self.order.PushFront(&lruEntry{key: key, table: t})
+	self.evict()
+}
+
+func (self *lruCache) resize(n int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.size = n
+	self.evict()
+}
+
+func (self *lruCache) evict() {
+	for self.order.Len() > max(self.size, 0) {
+		e := self.order.Back()
+		self.order.Remove(e)
+		delete(self.entries, e.Value.(*lruEntry).key) //nolint:forcetypeassert // only *lruEntry is stored
+	}
+}
@@ -0,0 +1,74 @@
+package kevs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCached(t *testing.T) {
+	defer SetParseCacheSize(defaultCacheSize)
+	SetParseCacheSize(1)
+
+	content := "a = { b = [ 1; ]; };\n"
+
+	first, err := ParseCached("none", content, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first[0].Value.Data.Table[0].Value.Data.List[0].Data.Integer = 42
+
+	second, err := ParseCached("none", content, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Parse("none", content, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(second, want) {
+		t.Fatal("cached table was modified through a returned copy")
+	}
+
+	if _, err := ParseCached("none", "b = 1;\n", Flags{}); err != nil {
+		t.Fatal(err)
+	}
+	if parseCache.order.Len() != 1 {
+		t.Fatal("cache exceeds its size")
+	}
+
+	if _, err := ParseCached("none", "b = x;\n", Flags{}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// closures made by the same function share their code pointer, but
+	// not their behavior
+	only := func(key string) func(string) bool {
+		return func(s string) bool { return s == key }
+	}
+	content = "a-b = 1;\n"
+	if _, err := ParseCached("none", content, Flags{IdentifierFunc: only("a-b")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseCached("none", content, Flags{IdentifierFunc: only("c")}); err == nil {
+		t.Fatal("expected error for a key rejected by IdentifierFunc")
+	}
+
+	t.Setenv("KEVS_CACHE_TEST", "x")
+	content = "a = \"${KEVS_CACHE_TEST}\";\n"
+	if _, err := ParseCached("none", content, Flags{ExpandEnv: true}); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KEVS_CACHE_TEST", "y")
+	root, err := ParseCached("none", content, Flags{ExpandEnv: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := root.GetString("a"); s != "y" {
+		t.Fatalf("stale value: %q", s)
+	}
+
+	SetParseCacheSize(0)
+	if parseCache.order.Len() != 0 {
+		t.Fatal("cache not emptied")
+	}
+}
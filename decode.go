@@ -0,0 +1,59 @@
+package kevs
+
+import (
+	"fmt"
+	"io"
+)
+
+// Decoder reads and decodes KEVS from an input stream.
+type Decoder struct {
+	r     io.Reader
+	flags Flags
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// NewDecoderWithFlags is like NewDecoder, but the input is parsed with the
+// given flags. With Flags.MaxInputSize set, reading stops past the limit, so
+// that a large stream is not held in memory only to be rejected.
+func NewDecoderWithFlags(r io.Reader, flags Flags) *Decoder {
+	return &Decoder{r: r, flags: flags}
+}
+
+// Decode reads all the input and parses it. If the reader has a Name
+// method, like *os.File, the name is used in error messages.
+func (self *Decoder) Decode() (Table, error) {
+	file := "<input>"
+	if named, ok := self.r.(interface{ Name() string }); ok {
+		file = named.Name()
+	}
+	r := self.r
+	max := self.flags.MaxInputSize
+	if max > 0 {
+		// one more byte tells an input of the maximum size from a larger one
+		r = io.LimitReader(r, int64(max)+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && len(data) > max {
+		return nil, &Error{
+			File:    file,
+			Stage:   "scan",
+			Message: fmt.Sprintf("input size exceeds maximum of %d", max),
+		}
+	}
+	return Parse(file, string(data), self.flags)
+}
+
+// DecodeStruct decodes the input and unmarshals it into dst.
+func (self *Decoder) DecodeStruct(dst any) error {
+	t, err := self.Decode()
+	if err != nil {
+		return err
+	}
+	return t.Unmarshal(dst)
+}
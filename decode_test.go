@@ -0,0 +1,85 @@
+package kevs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	root, err := NewDecoder(strings.NewReader("a = 1;\n")).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := root.GetInteger("a"); err != nil || v != 1 {
+		t.Fatal("fail:", v, err)
+	}
+
+	var d struct {
+		A int    `kevs:"a"`
+		B string `kevs:"b"`
+	}
+	if err := NewDecoder(strings.NewReader("a = 2;\nb = \"x\";\n")).DecodeStruct(&d); err != nil {
+		t.Fatal(err)
+	}
+	if d.A != 2 || d.B != "x" {
+		t.Fatal("fail:", d)
+	}
+
+	path := filepath.Join(t.TempDir(), "bad.kevs")
+	if err := os.WriteFile(path, []byte("a = x;\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = NewDecoder(f).Decode()
+	var e *Error
+	if !errors.As(err, &e) || e.File != path {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+// endless is an input stream which never ends.
+type endless struct {
+	read int
+}
+
+func (self *endless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = ' '
+	}
+	self.read += len(p)
+	return len(p), nil
+}
+
+func TestDecoderWithFlags(t *testing.T) {
+	root, err := NewDecoderWithFlags(strings.NewReader("a = 1;\na = 2;\n"), Flags{AllowDuplicateKeys: true}).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := root.GetInteger("a"); err != nil || v != 2 {
+		t.Fatal("fail:", v, err)
+	}
+	if _, err := NewDecoder(strings.NewReader("a = 1;\na = 2;\n")).Decode(); err == nil {
+		t.Fatal("expected error without flags")
+	}
+
+	if _, err := NewDecoderWithFlags(strings.NewReader("a = 1;\n"), Flags{MaxInputSize: 7}).Decode(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewDecoderWithFlags(strings.NewReader("a = 1;\n"), Flags{MaxInputSize: 6}).Decode()
+	if err == nil || err.Error() != "<input>: error: scan: input size exceeds maximum of 6" {
+		t.Fatal("unexpected error:", err)
+	}
+
+	r := &endless{}
+	_, err = NewDecoderWithFlags(r, Flags{MaxInputSize: 1024}).Decode()
+	if err == nil || r.read > 1<<20 {
+		t.Fatalf("unexpected result: read %d bytes, error %v", r.read, err)
+	}
+}
@@ -0,0 +1,724 @@
+package kevs
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultIndent = "    "
+
+// encoder writes a Table as KEVS text.
+type encoder struct {
+	w      io.Writer
+	indent string
+	err    error
+
+	// canonical sorts keys and writes integers in decimal
+	canonical bool
+}
+
+// Encoder writes KEVS to an output stream.
+type Encoder struct {
+	w      io.Writer
+	indent string
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		w:      w,
+		indent: defaultIndent,
+	}
+}
+
+// SetIndent sets the string written once per nesting level, four spaces by
+// default.
+func (self *Encoder) SetIndent(s string) {
+	self.indent = s
+}
+
+// Encode writes the KEVS text of the table, as Marshal would produce it.
+func (self *Encoder) Encode(t Table) error {
+	w := bufio.NewWriter(self.w)
+	e := encoder{
+		w:      w,
+		indent: self.indent,
+	}
+	if err := e.encode(t); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Marshal returns the KEVS text of the table. Nested tables and lists are
+// indented one level per depth.
+func Marshal(t Table) ([]byte, error) {
+	var buf bytes.Buffer
+	e := encoder{
+		w:      &buf,
+		indent: defaultIndent,
+	}
+	if err := e.encode(t); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// MarshalStruct returns the KEVS text of the struct v, or of the struct v
+// points to. Fields are encoded using the same kevs tags as Unmarshal;
+// fields implementing Marshaler encode themselves.
+func MarshalStruct(v any) ([]byte, error) {
+	t, err := struct_to_table(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return Marshal(t)
+}
+
+func struct_to_table(v reflect.Value) (Table, error) {
+	if v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, errors.New("source must be a struct or a pointer to a struct")
+	}
+	if !v.CanAddr() {
+		// make a copy so that methods with pointer receivers can be called
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		v = c
+	}
+	return fields_to_table(v, []reflect.Type{v.Type()})
+}
+
+// fields_to_table converts the addressable struct v into a table. path is
+// as for unmarshal_struct. As in encoding/json, the shallower field wins: a
+// key promoted from an embedded struct is dropped if a field of v has a tag
+// with the same first segment, even when that field is omitted, or if an
+// earlier embedded struct already gave it.
+func fields_to_table(v reflect.Value, path []reflect.Type) (Table, error) {
+	t := v.Type()
+	shadowed := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if _, ok := embedded_struct(f); ok || !f.IsExported() {
+			continue
+		}
+		if tag, found := f.Tag.Lookup(reflectTag); found && tag != "-" {
+			opts, _ := parse_tag(tag)
+			head, _, _ := strings.Cut(opts.name, ".")
+			shadowed[head] = true
+		}
+	}
+
+	var out Table
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if et, ok := embedded_struct(f); ok {
+			fv := v.Field(i)
+			if slices.Contains(path, et) || (fv.Kind() == reflect.Pointer && fv.IsNil()) {
+				continue
+			}
+			fv = reflect.Indirect(fv)
+			promoted, err := fields_to_table(fv, append(slices.Clip(path), et))
+			if err != nil {
+				return nil, err
+			}
+			for _, kv := range promoted {
+				if !shadowed[kv.Key] && out.index_of(kv.Key, false) == -1 {
+					out = append(out, kv)
+				}
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		tag, found := f.Tag.Lookup(reflectTag)
+		if !found || tag == "-" {
+			continue
+		}
+		opts, err := parse_tag(tag)
+		if err != nil {
+			return nil, fmt.Errorf("struct '%s': field '%s': %w", t.Name(), f.Name, err)
+		}
+		// nil pointers are absent optional values
+		if v.Field(i).Kind() == reflect.Pointer && v.Field(i).IsNil() {
+			continue
+		}
+		if opts.omitEmpty && is_empty_value(v.Field(i)) {
+			continue
+		}
+		val, err := to_value(v.Field(i))
+		if err != nil {
+			return nil, fmt.Errorf("struct '%s': field '%s': %w", t.Name(), f.Name, err)
+		}
+		out = out.put_path(opts.name, val)
+	}
+	return out, nil
+}
+
+// is_empty_value reports whether v is empty for the omitempty tag option:
+// false, zero, an empty string, list or map, or a nil pointer or interface.
+func is_empty_value(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return v.IsZero()
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	default:
+		return false
+	}
+}
+
+func to_value(v reflect.Value) (Value, error) {
+	if m, ok := as_marshaler(v); ok {
+		return m.MarshalKEVS()
+	}
+	if v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+	}
+	out := Value{}
+	if v.Type() == timeType {
+		out.Kind = ValueKindString
+		out.Data.String = v.Interface().(time.Time).Format(time.RFC3339Nano) //nolint:forcetypeassert // checked above
+		return out, nil
+	}
+	if v.Type() == durationType {
+		out.Kind = ValueKindString
+		out.Data.String = time.Duration(v.Int()).String()
+		return out, nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		out.Kind = ValueKindString
+		out.Data.String = v.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		out.Kind = ValueKindInteger
+		out.Data.Integer = v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		out.Kind = ValueKindInteger
+		if n := v.Uint(); n > math.MaxInt64 {
+			out.Data.Uint = n
+		} else {
+			out.Data.Integer = int64(n)
+		}
+	case reflect.Float32, reflect.Float64:
+		out.Kind = ValueKindFloat
+		out.Data.Float = v.Float()
+	case reflect.Bool:
+		out.Kind = ValueKindBoolean
+		out.Data.Boolean = v.Bool()
+	case reflect.Slice, reflect.Array:
+		out.Kind = ValueKindList
+		for i := 0; i < v.Len(); i++ {
+			item, err := to_value(v.Index(i))
+			if err != nil {
+				return Value{}, fmt.Errorf("element %d: %w", i, err)
+			}
+			out.Data.List = append(out.Data.List, item)
+		}
+	case reflect.Struct:
+		t, err := struct_to_table(v)
+		if err != nil {
+			return Value{}, err
+		}
+		out.Kind = ValueKindTable
+		out.Data.Table = t
+	default:
+		return Value{}, fmt.Errorf("cannot encode type %s", v.Type())
+	}
+	return out, nil
+}
+
+// as_marshaler returns the Marshaler implemented by v or by a pointer to v.
+func as_marshaler(v reflect.Value) (Marshaler, bool) {
+	if v.Kind() == reflect.Pointer && v.IsNil() {
+		return nil, false
+	}
+	if m, ok := v.Interface().(Marshaler); ok {
+		return m, true
+	}
+	if !v.CanAddr() {
+		return nil, false
+	}
+	m, ok := v.Addr().Interface().(Marshaler)
+	return m, ok
+}
+
+// put_path appends val under the dotted path key, creating nested tables
+// as needed.
+func (self Table) put_path(key string, val Value) Table {
+	head, rest, found := strings.Cut(key, ".")
+	if !found {
+		return append(self, KeyValue{Key: key, Value: val})
+	}
+	for i := range self {
+		if self[i].Key == head && self[i].Value.Kind == ValueKindTable {
+			self[i].Value.Data.Table = self[i].Value.Data.Table.put_path(rest, val)
+			return self
+		}
+	}
+	sub := Value{Kind: ValueKindTable}
+	sub.Data.Table = sub.Data.Table.put_path(rest, val)
+	return append(self, KeyValue{Key: head, Value: sub})
+}
+
+// Canonicalize parses content and emits it in canonical form: keys sorted
+// recursively, strings with minimal escaping, integers in decimal and no
+// comments. Semantically equal inputs canonicalize to identical bytes.
+func Canonicalize(content string) ([]byte, error) {
+	root, err := Parse("<input>", content, Flags{})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	e := encoder{
+		w:         &buf,
+		indent:    defaultIndent,
+		canonical: true,
+	}
+	if err := e.encode(root); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Format parses content and emits it with consistent indentation and
+// spacing: one key-value, element or comment per line, nested values
+// indented by four spaces, one space around '=' and before ';'. Keys,
+// values and comments are written as found, so dotted keys, raw strings,
+// heredocs, integer bases and all comments are kept, and runs of blank
+// lines become one. Comments at the end of a line stay there. Formatting
+// is idempotent.
+func Format(content string) ([]byte, error) {
+	return FormatWithFlags(content, Flags{})
+}
+
+// FormatWithFlags is like Format, for content parsed with the given flags,
+// e.g. a CommentPrefix or AnonymousSections. KeepComments is always set.
+// AllowTrailingContent is rejected, as the trailing content would be lost.
+func FormatWithFlags(content string, flags Flags) ([]byte, error) {
+	if flags.AllowTrailingContent {
+		return nil, errors.New("flag AllowTrailingContent cannot be used to format, the trailing content would be lost")
+	}
+	flags.KeepComments = true
+	// values are checked by the parser, e.g. references
+	if _, err := Parse("<input>", content, flags); err != nil {
+		return nil, err
+	}
+	tokens, err := Scan("<input>", content, flags)
+	if err != nil {
+		return nil, err
+	}
+	f := new_formatter(content, flags)
+	for _, tok := range tokens {
+		f.write(tok)
+	}
+	if f.buf.Len() != 0 {
+		f.buf.WriteByte('\n')
+	}
+	return f.buf.Bytes(), nil
+}
+
+// formatter writes tokens back as text for Format.
+type formatter struct {
+	buf bytes.Buffer
+
+	// src is the input as seen by the scanner, lines the offset in src
+	// of each line
+	src   string
+	lines []int
+
+	depth int
+	last  int  // line on which the last token written ends
+	cont  bool // the next value continues the line, after '='
+	open  bool // the last token written is '{' or '['
+}
+
+func new_formatter(content string, flags Flags) *formatter {
+	src := normalize_newlines(strings.TrimPrefix(content, utf8BOM), flags.comment_prefix())
+	lines := []int{0}
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\n' {
+			lines = append(lines, i+1)
+		}
+	}
+	return &formatter{src: src, lines: lines}
+}
+
+// in_source reports whether tok is found in the input at its position,
+// unlike the key, separator and semicolon added to anonymous sections.
+func (self *formatter) in_source(tok Token) bool {
+	if tok.Line < 1 || tok.Line > len(self.lines) {
+		return false
+	}
+	off := self.lines[tok.Line-1] + tok.Column - 1
+	return off <= len(self.src) && strings.HasPrefix(self.src[off:], tok.Value)
+}
+
+func (self *formatter) write(tok Token) {
+	if !self.in_source(tok) {
+		return
+	}
+	open := false
+	switch {
+	case tok.Kind == TokenKindComment && self.buf.Len() != 0 && tok.Line == self.last:
+		// a comment at the end of a line stays there
+		self.buf.WriteByte(' ')
+		self.buf.WriteString(tok.Value)
+
+	case tok.Kind == TokenKindDelim && tok.Value == string(kKeyValSep):
+		self.buf.WriteString(" = ")
+		self.cont = true
+
+	case tok.Kind == TokenKindDelim && tok.Value == string(kKeyValEnd):
+		self.buf.WriteString(" ;")
+
+	case tok.Kind == TokenKindDelim && (tok.Value == string(kTableEnd) || tok.Value == string(kListEnd)):
+		self.depth--
+		if !self.open {
+			// empty tables and lists stay on one line
+			self.newline(tok, false)
+		}
+		self.buf.WriteString(tok.Value)
+
+	default:
+		// keys, values, '{', '[' and the comments on their own line
+		if !self.cont {
+			self.newline(tok, true)
+		}
+		self.cont = false
+		self.buf.WriteString(tok.Value)
+		if tok.Kind == TokenKindDelim {
+			self.depth++
+			open = true
+		}
+	}
+	self.open = open
+	self.last = tok.Line + strings.Count(tok.Value, "\n")
+}
+
+// newline starts a new line, indented, for tok. A blank line before tok is
+// kept if blank is set, unless tok is the first of a table or list.
+func (self *formatter) newline(tok Token, blank bool) {
+	if self.buf.Len() == 0 {
+		return
+	}
+	self.buf.WriteByte('\n')
+	if blank && !self.open && tok.Line > self.last+1 {
+		self.buf.WriteByte('\n')
+	}
+	for range self.depth {
+		self.buf.WriteString(defaultIndent)
+	}
+}
+
+func (self *encoder) encode(t Table) error {
+	self.encode_table(t, 0)
+	return self.err
+}
+
+func (self *encoder) write(s string) {
+	if self.err != nil {
+		return
+	}
+	_, self.err = io.WriteString(self.w, s)
+}
+
+func (self *encoder) write_indent(depth int) {
+	for range depth {
+		self.write(self.indent)
+	}
+}
+
+func (self *encoder) encode_table(t Table, depth int) {
+	if self.canonical {
+		t = slices.Clone(t)
+		slices.SortFunc(t, func(a, b KeyValue) int {
+			return strings.Compare(a.Key, b.Key)
+		})
+	}
+	for _, kv := range t {
+		// the key would not be read back as is
+		if !is_identifier(kv.Key) {
+			if self.err == nil {
+				self.err = fmt.Errorf("key '%s' is not a valid identifier", kv.Key)
+			}
+			return
+		}
+		self.write_comments(kv.Comments, depth)
+		self.write_indent(depth)
+		self.write(kv.Key)
+		self.write(" = ")
+		self.encode_value(kv.Value, depth)
+		self.end_line(kv.Comment)
+		self.write_comments(kv.Trailing, depth)
+	}
+}
+
+// write_comments writes comment lines, each on its own line.
+func (self *encoder) write_comments(comments []string, depth int) {
+	for _, c := range comments {
+		self.write_indent(depth)
+		self.write(c)
+		self.write("\n")
+	}
+}
+
+// end_line ends a key-value or list element, with its comment if any.
+func (self *encoder) end_line(comment string) {
+	self.write(";")
+	if comment != "" {
+		self.write(" ")
+		self.write(comment)
+	}
+	self.write("\n")
+}
+
+func (self *encoder) encode_value(v Value, depth int) {
+	switch v.Kind {
+	case ValueKindString:
+		self.write(quote_string(v.Data.String))
+
+	case ValueKindInteger:
+		if self.canonical {
+			self.write(v.FormatInteger(10))
+		} else {
+			self.write(v.FormatInteger(int(v.Data.Base)))
+		}
+
+	case ValueKindFloat:
+		if math.IsInf(v.Data.Float, 0) || math.IsNaN(v.Data.Float) {
+			if self.err == nil {
+				self.err = fmt.Errorf("cannot encode float %v", v.Data.Float)
+			}
+			return
+		}
+		self.write(format_float(v.Data.Float))
+
+	case ValueKindBoolean:
+		self.write(strconv.FormatBool(v.Data.Boolean))
+
+	case ValueKindNull:
+		self.write("null")
+
+	case ValueKindList:
+		if len(v.Data.List) == 0 {
+			self.write("[]")
+			return
+		}
+		self.write("[\n")
+		for _, item := range v.Data.List {
+			self.write_comments(item.Comments, depth+1)
+			self.write_indent(depth + 1)
+			self.encode_value(item, depth+1)
+			self.end_line(item.Comment)
+			self.write_comments(item.Trailing, depth+1)
+		}
+		self.write_indent(depth)
+		self.write("]")
+
+	case ValueKindTable:
+		if len(v.Data.Table) == 0 {
+			self.write("{}")
+			return
+		}
+		self.write("{\n")
+		self.encode_table(v.Data.Table, depth+1)
+		self.write_indent(depth)
+		self.write("}")
+
+	default:
+		if self.err == nil {
+			self.err = fmt.Errorf("cannot encode value of kind %s", v.Kind)
+		}
+	}
+}
+
+// quote_string is the inverse of normString: it quotes s, escaping only
+// the characters that cannot appear verbatim in a string value.
+func quote_string(s string) string {
+	var dst strings.Builder
+	dst.WriteByte(kStringBegin)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"':
+			dst.WriteString(`\"`)
+		case '\\':
+			dst.WriteString(`\\`)
+		case '\a':
+			dst.WriteString(`\a`)
+		case '\b':
+			dst.WriteString(`\b`)
+		case '\f':
+			dst.WriteString(`\f`)
+		case '\n':
+			dst.WriteString(`\n`)
+		case '\r':
+			dst.WriteString(`\r`)
+		case '\t':
+			dst.WriteString(`\t`)
+		case '\v':
+			dst.WriteString(`\v`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				fmt.Fprintf(&dst, `\u%04x`, c)
+			} else {
+				dst.WriteByte(c)
+			}
+		}
+	}
+	dst.WriteByte(kStringBegin)
+	return dst.String()
+}
+
+// GoLiteral renders the table as Go source that constructs an equal
+// kevs.Table, e.g. to compile a default config into a program.
+func (self Table) GoLiteral() string {
+	var dst strings.Builder
+	write_go_table(&dst, self, 0)
+	return dst.String()
+}
+
+func write_go_table(dst *strings.Builder, t Table, depth int) {
+	if len(t) == 0 {
+		dst.WriteString("kevs.Table{}")
+		return
+	}
+	dst.WriteString("kevs.Table{\n")
+	for _, kv := range t {
+		dst.WriteString(strings.Repeat("\t", depth+1))
+		fmt.Fprintf(dst, "{Key: %s, Value: ", strconv.Quote(kv.Key))
+		write_go_value(dst, kv.Value, depth+1)
+		dst.WriteString("},\n")
+	}
+	dst.WriteString(strings.Repeat("\t", depth))
+	dst.WriteString("}")
+}
+
+func write_go_value(dst *strings.Builder, v Value, depth int) {
+	switch v.Kind {
+	case ValueKindString:
+		fmt.Fprintf(dst, "kevs.Value{Kind: kevs.ValueKindString, Data: kevs.ValueData{String: %s}}", strconv.Quote(v.Data.String))
+
+	case ValueKindInteger:
+		data := fmt.Sprintf("Integer: %d", v.Data.Integer)
+		if v.Data.Uint != 0 {
+			data = fmt.Sprintf("Uint: %d", v.Data.Uint)
+		}
+		if v.Data.Base != 0 {
+			data += fmt.Sprintf(", Base: %d", v.Data.Base)
+		}
+		fmt.Fprintf(dst, "kevs.Value{Kind: kevs.ValueKindInteger, Data: kevs.ValueData{%s}}", data)
+
+	case ValueKindFloat:
+		f := strconv.FormatFloat(v.Data.Float, 'g', -1, 64)
+		switch {
+		case math.IsNaN(v.Data.Float):
+			f = "math.NaN()"
+		case math.IsInf(v.Data.Float, 0):
+			f = fmt.Sprintf("math.Inf(%d)", int(math.Copysign(1, v.Data.Float)))
+		}
+		fmt.Fprintf(dst, "kevs.Value{Kind: kevs.ValueKindFloat, Data: kevs.ValueData{Float: %s}}", f)
+
+	case ValueKindBoolean:
+		fmt.Fprintf(dst, "kevs.Value{Kind: kevs.ValueKindBoolean, Data: kevs.ValueData{Boolean: %t}}", v.Data.Boolean)
+
+	case ValueKindNull:
+		dst.WriteString("kevs.Value{Kind: kevs.ValueKindNull}")
+
+	case ValueKindList:
+		dst.WriteString("kevs.Value{Kind: kevs.ValueKindList, Data: kevs.ValueData{List: ")
+		if len(v.Data.List) == 0 {
+			dst.WriteString("kevs.List{}")
+		} else {
+			dst.WriteString("kevs.List{\n")
+			for _, item := range v.Data.List {
+				dst.WriteString(strings.Repeat("\t", depth+1))
+				write_go_value(dst, item, depth+1)
+				dst.WriteString(",\n")
+			}
+			dst.WriteString(strings.Repeat("\t", depth))
+			dst.WriteString("}")
+		}
+		dst.WriteString("}}")
+
+	case ValueKindTable:
+		dst.WriteString("kevs.Value{Kind: kevs.ValueKindTable, Data: kevs.ValueData{Table: ")
+		write_go_table(dst, v.Data.Table, depth)
+		dst.WriteString("}}")
+
+	default:
+		fmt.Fprintf(dst, "kevs.Value{Kind: %d}", v.Kind)
+	}
+}
+
+// String returns the value as it would appear in KEVS text, on one line.
+func (self Value) String() string {
+	var dst strings.Builder
+	write_inline(&dst, self)
+	return dst.String()
+}
+
+func write_inline(dst *strings.Builder, v Value) {
+	switch v.Kind {
+	case ValueKindString:
+		dst.WriteString(quote_string(v.Data.String))
+
+	case ValueKindInteger:
+		dst.WriteString(v.FormatInteger(int(v.Data.Base)))
+
+	case ValueKindFloat:
+		dst.WriteString(format_float(v.Data.Float))
+
+	case ValueKindBoolean:
+		dst.WriteString(strconv.FormatBool(v.Data.Boolean))
+
+	case ValueKindNull:
+		dst.WriteString("null")
+
+	case ValueKindList:
+		if len(v.Data.List) == 0 {
+			dst.WriteString("[]")
+			return
+		}
+		dst.WriteString("[ ")
+		for _, item := range v.Data.List {
+			write_inline(dst, item)
+			dst.WriteString("; ")
+		}
+		dst.WriteString("]")
+
+	case ValueKindTable:
+		if len(v.Data.Table) == 0 {
+			dst.WriteString("{}")
+			return
+		}
+		dst.WriteString("{ ")
+		for _, kv := range v.Data.Table {
+			dst.WriteString(kv.Key)
+			dst.WriteString(" = ")
+			write_inline(dst, kv.Value)
+			dst.WriteString("; ")
+		}
+		dst.WriteString("}")
+
+	default:
+		dst.WriteString(v.Kind.String())
+	}
+}
@@ -0,0 +1,606 @@
+package kevs
+
+import (
+	"bytes"
+	"fmt"
+	goparser "go/parser"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type hexColor uint32
+
+func (self hexColor) MarshalKEVS() (Value, error) {
+	v := Value{Kind: ValueKindString}
+	v.Data.String = fmt.Sprintf("#%06x", uint32(self))
+	return v, nil
+}
+
+type colorSet []hexColor
+
+func (self *colorSet) MarshalKEVS() (Value, error) {
+	v := Value{Kind: ValueKindList}
+	for _, c := range *self {
+		item, err := c.MarshalKEVS()
+		if err != nil {
+			return Value{}, err
+		}
+		v.Data.List = append(v.Data.List, item)
+	}
+	return v, nil
+}
+
+func TestMarshaler(t *testing.T) {
+	type data struct {
+		Name    string   `kevs:"name"`
+		Color   hexColor `kevs:"color"`
+		Palette colorSet `kevs:"palette"`
+	}
+
+	d := data{Name: "theme", Color: 0xff8800, Palette: colorSet{0x000000, 0xffffff}}
+	out, err := struct_to_table(reflect.ValueOf(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	str := func(s string) Value {
+		v := Value{Kind: ValueKindString}
+		v.Data.String = s
+		return v
+	}
+	palette := Value{Kind: ValueKindList}
+	palette.Data.List = List{str("#000000"), str("#ffffff")}
+	want := Table{
+		{Key: "name", Value: str("theme")},
+		{Key: "color", Value: str("#ff8800")},
+		{Key: "palette", Value: palette},
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Fatalf("unexpected table: %+v", out)
+	}
+
+	nested := struct {
+		Port int    `kevs:"server.port"`
+		Host string `kevs:"server.host"`
+	}{80, "localhost"}
+	out, err = struct_to_table(reflect.ValueOf(nested))
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := out.lookup("server.port")
+	if err != nil || port.Data.Integer != 80 {
+		t.Fatalf("unexpected table: %+v", out)
+	}
+	if len(out) != 1 || len(out[0].Value.Data.Table) != 2 {
+		t.Fatalf("unexpected table: %+v", out)
+	}
+
+	if _, err := struct_to_table(reflect.ValueOf(42)); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	a := `
+# server settings
+server = { port = 0x1f90; host = "localhost"; };
+name = "tab\there";
+tags = [ "b"; "a"; ];
+empty = {};
+`
+	b := "name = \"tab\\u0009here\";\nempty={};\ntags=[\"b\";\"a\";];\nserver={\n  host=`localhost`;\n  port=8080;\n};\n"
+
+	want := `empty = {};
+name = "tab\there";
+server = {
+    host = "localhost";
+    port = 8080;
+};
+tags = [
+    "b";
+    "a";
+];
+`
+
+	for _, in := range []string{a, b} {
+		out, err := Canonicalize(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != want {
+			t.Log("want:", want)
+			t.Log("have:", string(out))
+			t.Fatal("unexpected output")
+		}
+	}
+}
+
+func Test_quote_string(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"", `""`},
+		{"abc", `"abc"`},
+		{`a"b`, `"a\"b"`},
+		{`a\b`, `"a\\b"`},
+		{"a\nb", `"a\nb"`},
+		{"\x01", `"\u0001"`},
+		{"ü", `"ü"`},
+	}
+
+	for _, test := range tests {
+		out := quote_string(test.in)
+		if out != test.out {
+			t.Errorf("want %s, have %s", test.out, out)
+		}
+		back, err := normString(out[1 : len(out)-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if back != test.in {
+			t.Errorf("round-trip: want %q, have %q", test.in, back)
+		}
+	}
+}
+
+func TestGoLiteral(t *testing.T) {
+	root, err := Parse("none", `
+name = "a\"b";
+port = -1;
+debug = true;
+tags = [ "x"; [ 1; ]; ];
+server = { host = "h"; };
+empty = [];
+`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `kevs.Table{
+	{Key: "name", Value: kevs.Value{Kind: kevs.ValueKindString, Data: kevs.ValueData{String: "a\"b"}}},
+	{Key: "port", Value: kevs.Value{Kind: kevs.ValueKindInteger, Data: kevs.ValueData{Integer: -1}}},
+	{Key: "debug", Value: kevs.Value{Kind: kevs.ValueKindBoolean, Data: kevs.ValueData{Boolean: true}}},
+	{Key: "tags", Value: kevs.Value{Kind: kevs.ValueKindList, Data: kevs.ValueData{List: kevs.List{
+		kevs.Value{Kind: kevs.ValueKindString, Data: kevs.ValueData{String: "x"}},
+		kevs.Value{Kind: kevs.ValueKindList, Data: kevs.ValueData{List: kevs.List{
+			kevs.Value{Kind: kevs.ValueKindInteger, Data: kevs.ValueData{Integer: 1}},
+		}}},
+	}}}},
+	{Key: "server", Value: kevs.Value{Kind: kevs.ValueKindTable, Data: kevs.ValueData{Table: kevs.Table{
+		{Key: "host", Value: kevs.Value{Kind: kevs.ValueKindString, Data: kevs.ValueData{String: "h"}}},
+	}}}},
+	{Key: "empty", Value: kevs.Value{Kind: kevs.ValueKindList, Data: kevs.ValueData{List: kevs.List{}}}},
+}`
+
+	have := root.GoLiteral()
+	if have != want {
+		t.Log("want:", want)
+		t.Log("have:", have)
+		t.Fatal("unexpected output")
+	}
+
+	if _, err := goparser.ParseExpr(have); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		in  Table
+		out string
+	}{
+		{
+			Table{{Key: "s", Value: Value{Kind: ValueKindString, Data: ValueData{String: "a\"b\\c\n"}}}},
+			"s = \"a\\\"b\\\\c\\n\";\n",
+		},
+		{
+			Table{{Key: "i", Value: Value{Kind: ValueKindInteger, Data: ValueData{Integer: -42}}}},
+			"i = -42;\n",
+		},
+		{
+			Table{{Key: "b", Value: Value{Kind: ValueKindBoolean, Data: ValueData{Boolean: true}}}},
+			"b = true;\n",
+		},
+		{
+			Table{{Key: "l", Value: Value{Kind: ValueKindList}}},
+			"l = [];\n",
+		},
+		{
+			Table{{Key: "t", Value: Value{Kind: ValueKindTable}}},
+			"t = {};\n",
+		},
+		{
+			Table{
+				{Key: "l", Value: Value{Kind: ValueKindList, Data: ValueData{List: List{
+					{Kind: ValueKindInteger, Data: ValueData{Integer: 1}},
+					{Kind: ValueKindTable, Data: ValueData{Table: Table{
+						{Key: "x", Value: Value{Kind: ValueKindBoolean}},
+					}}},
+				}}}},
+			},
+			"l = [\n    1;\n    {\n        x = false;\n    };\n];\n",
+		},
+	}
+
+	for _, test := range tests {
+		out, err := Marshal(test.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != test.out {
+			t.Errorf("want %q, have %q", test.out, out)
+		}
+		back, err := Parse("none", string(out), Flags{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(without_positions(back), test.in) {
+			t.Errorf("round-trip: want %v, have %v", test.in, back)
+		}
+	}
+
+	if _, err := Marshal(Table{{Key: "u", Value: Value{}}}); err == nil {
+		t.Fatal("expected error for undefined value")
+	}
+
+	for _, key := range []string{"my key", "", "1a", "a.b", "log-level"} {
+		nested := Table{{Key: "t", Value: TableValue(Table{{Key: key, Value: IntegerValue(1)}})}}
+		for _, in := range []Table{{{Key: key, Value: IntegerValue(1)}}, nested} {
+			out, err := Marshal(in)
+			want := fmt.Sprintf("key '%s' is not a valid identifier", key)
+			if err == nil || err.Error() != want || out != nil {
+				t.Errorf("%q: want error %q, have %q, %v", key, want, out, err)
+			}
+		}
+	}
+}
+
+func TestMarshalStruct(t *testing.T) {
+	type data struct {
+		String  string   `kevs:"string"`
+		Integer int      `kevs:"integer"`
+		Boolean bool     `kevs:"boolean"`
+		List    []string `kevs:"list"`
+		Struct  struct {
+			X int    `kevs:"x"`
+			Y string `kevs:"y"`
+		} `kevs:"struct"`
+		Port     int `kevs:"server.port"`
+		Untagged int
+		hidden   int `kevs:"hidden"`
+	}
+
+	content := `
+string = "42";
+integer = 42;
+boolean = true;
+list = [ "aa"; "bb"; ];
+struct = { x = 2; y = "3"; };
+server = { port = 80; };
+`
+
+	root, err := Parse("none", content, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d data
+	if err := root.Unmarshal(&d); err != nil {
+		t.Fatal(err)
+	}
+	d.Untagged = 1
+	d.hidden = 1
+
+	out, err := MarshalStruct(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := Parse("none", string(out), Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(without_positions(back), without_positions(root)) {
+		t.Log(string(out))
+		t.Fatal("round-trip mismatch")
+	}
+
+	var d2 data
+	if err := back.Unmarshal(&d2); err != nil {
+		t.Fatal(err)
+	}
+	d2.Untagged = 1
+	d2.hidden = 1
+	if !reflect.DeepEqual(d, d2) {
+		t.Fatal("fail")
+	}
+
+	color := struct {
+		Color hexColor `kevs:"color"`
+	}{0xff8800}
+	out, err = MarshalStruct(&color)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "color = \"#ff8800\";\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	if _, err := MarshalStruct(42); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	root, err := Parse("none", "a = { b = [ 1; ]; };\n", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(root); err != nil {
+		t.Fatal(err)
+	}
+	out, err := Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != string(out) {
+		t.Fatalf("want %q, have %q", out, buf.String())
+	}
+
+	buf.Reset()
+	e := NewEncoder(&buf)
+	e.SetIndent("\t")
+	if err := e.Encode(root); err != nil {
+		t.Fatal(err)
+	}
+	want := "a = {\n\tb = [\n\t\t1;\n\t];\n};\n"
+	if buf.String() != want {
+		t.Fatalf("want %q, have %q", want, buf.String())
+	}
+}
+
+func TestValueString(t *testing.T) {
+	root, err := Parse("none", `
+s = "a\"b\n";
+i = -1;
+b = false;
+l = [ 1; "x"; []; ];
+t = { a = 1; b = { c = true; }; e = {}; };
+`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		`"a\"b\n"`,
+		`-1`,
+		`false`,
+		`[ 1; "x"; []; ]`,
+		`{ a = 1; b = { c = true; }; e = {}; }`,
+	}
+	for i, kv := range root {
+		if have := kv.Value.String(); have != want[i] {
+			t.Errorf("%s: want %s, have %s", kv.Key, want[i], have)
+		}
+	}
+
+	if have := (Value{}).String(); have != "undefined" {
+		t.Errorf("want undefined, have %s", have)
+	}
+}
+
+func TestIntegerBase(t *testing.T) {
+	content := "a = 0xff;\nb = -0o17;\nc = 0b101;\nd = 42;\n"
+
+	out, err := Marshal(mustParse(t, content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != content {
+		t.Fatalf("want %q, have %q", content, out)
+	}
+
+	out, err = Canonicalize(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "a = 255;\nb = -15;\nc = 5;\nd = 42;\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	tests := []struct {
+		n    int64
+		base int
+		out  string
+	}{
+		{255, 16, "0xff"},
+		{-15, 8, "-0o17"},
+		{5, 2, "0b101"},
+		{42, 10, "42"},
+		{42, 0, "42"},
+		{42, 7, "42"},
+		{math.MinInt64, 16, "-0x8000000000000000"},
+	}
+	for _, test := range tests {
+		v := Value{Kind: ValueKindInteger}
+		v.Data.Integer = test.n
+		if have := v.FormatInteger(test.base); have != test.out {
+			t.Errorf("want %s, have %s", test.out, have)
+		}
+	}
+}
+
+func mustParse(t *testing.T, content string) Table {
+	t.Helper()
+	root, err := Parse("none", content, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// without_positions returns a copy of t with the positions of the key-values
+// cleared, to compare tables parsed from different text.
+func without_positions(t Table) Table {
+	out := t.Clone()
+	_ = out.Walk(func(_ []string, v Value) error {
+		for i := range v.Data.Table {
+			v.Data.Table[i].Line = 0
+			v.Data.Table[i].Column = 0
+		}
+		return nil
+	})
+	for i := range out {
+		out[i].Line = 0
+		out[i].Column = 0
+	}
+	return out
+}
+
+func TestMarshalFloats(t *testing.T) {
+	tests := []struct {
+		in  float64
+		out string
+	}{
+		{1, "1.0"},
+		{-0.25, "-0.25"},
+		{1e6, "1e+06"},
+		{2.5e-3, "0.0025"},
+		{1e21, "1e+21"},
+		{1e-7, "1e-07"},
+	}
+	for _, test := range tests {
+		root := Table{{Key: "f", Value: FloatValue(test.in)}}
+		out, err := Marshal(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "f = " + test.out + ";\n"; string(out) != want {
+			t.Errorf("want %q, have %q", want, out)
+		}
+		back := mustParse(t, string(out))
+		if !back.Equal(root) {
+			t.Errorf("round-trip: want %v, have %v", root, back)
+		}
+	}
+
+	for _, f := range []float64{math.Inf(1), math.NaN()} {
+		if _, err := Marshal(Table{{Key: "f", Value: FloatValue(f)}}); err == nil {
+			t.Errorf("%v: expected error", f)
+		}
+	}
+
+	out, err := MarshalStruct(struct {
+		Rate float32 `kevs:"rate"`
+		Skip float64 `kevs:"skip,omitempty"`
+	}{Rate: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "rate = 0.5;\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	lit := Table{{Key: "f", Value: FloatValue(1e6)}}.GoLiteral()
+	if !strings.Contains(lit, "kevs.ValueData{Float: 1e+06}") {
+		t.Fatalf("unexpected literal: %s", lit)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	a := `
+# server settings
+server={port=0x1f90;   host =    ` + "`localhost`" + `;
+  # the tags
+  tags=[ "b";"a"; # last
+  # end of list
+  ];};
+
+
+name   =  "tab\there"; # the empty table
+empty = {};
+db.user = "admin";
+motd = <<END
+  keep   this
+END;
+# end of file
+`
+	b := "# server settings\nserver = {\n\tport = 0x1f90 ;\n\thost = `localhost`;\n\t# the tags\n\ttags = [\n\n\t\t\"b\" ;\n\t\t\"a\"; # last\n\t\t# end of list\n\t] ;\n} ;\n\nname = \"tab\\there\";    # the empty table\nempty={ };\ndb.user=\"admin\";\nmotd = <<END\n  keep   this\nEND ;\n  # end of file"
+
+	want := `# server settings
+server = {
+    port = 0x1f90 ;
+    host = ` + "`localhost`" + ` ;
+    # the tags
+    tags = [
+        "b" ;
+        "a" ; # last
+        # end of list
+    ] ;
+} ;
+
+name = "tab\there" ; # the empty table
+empty = {} ;
+db.user = "admin" ;
+motd = <<END
+  keep   this
+END ;
+# end of file
+`
+
+	for _, in := range []string{a, b} {
+		out, err := Format(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != want {
+			t.Log("want:", want)
+			t.Log("have:", string(out))
+			t.Fatal("unexpected output")
+		}
+		again, err := Format(string(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again, out) {
+			t.Fatalf("not idempotent: %q", again)
+		}
+	}
+
+	tests := []struct {
+		flags   Flags
+		in, out string
+	}{
+		{Flags{CommentPrefix: "//"}, "// c\na=1;// d\n", "// c\na = 1 ; // d\n"},
+		{Flags{AnonymousSections: true}, "{a=1;}\n[ 1; ];{}", "{\n    a = 1 ;\n}\n[\n    1 ;\n] ;\n{}\n"},
+		{Flags{AllowReferences: true}, "base={x=1;};copy=@base.x;", "base = {\n    x = 1 ;\n} ;\ncopy = @base.x ;\n"},
+		{Flags{}, "", ""},
+		{Flags{}, "# only\n", "# only\n"},
+	}
+	for _, test := range tests {
+		out, err := FormatWithFlags(test.in, test.flags)
+		if err != nil {
+			t.Fatalf("%q: %v", test.in, err)
+		}
+		if string(out) != test.out {
+			t.Fatalf("%q: want %q, have %q", test.in, test.out, out)
+		}
+		again, err := FormatWithFlags(string(out), test.flags)
+		if err != nil || !bytes.Equal(again, out) {
+			t.Fatalf("%q: not idempotent: %q, %v", test.in, again, err)
+		}
+	}
+
+	if _, err := Format("a = ;"); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := FormatWithFlags("a = @b;", Flags{AllowReferences: true}); err == nil {
+		t.Fatal("expected error for undefined reference")
+	}
+	if _, err := FormatWithFlags("a = 1; junk", Flags{AllowTrailingContent: true}); err == nil {
+		t.Fatal("expected error for AllowTrailingContent")
+	}
+}
@@ -0,0 +1,225 @@
+package kevs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const kInclude = "include"
+
+// include is an include directive: include "path";
+type include struct {
+	path string
+	line int
+
+	// token is the number of tokens before the directive, which is where
+	// the included key-values go
+	token int
+}
+
+// expect_include reports whether the input starts with an include
+// directive, as opposed to a key named include.
+func (self *scanner) expect_include() bool {
+	rest, found := strings.CutPrefix(self.params.content, kInclude)
+	if !found {
+		return false
+	}
+	trimmed := strings.TrimLeft(rest, spaces)
+	return len(trimmed) < len(rest) && strings.HasPrefix(trimmed, string(kStringBegin))
+}
+
+func (self *scanner) scan_include() bool {
+	line := self.line
+	self.advance(len(kInclude))
+	self.trim_space()
+
+	end := strings.IndexAny(self.params.content[1:], "\"\n")
+	if end == -1 || self.params.content[1+end] != kStringBegin {
+		self.errorf("include path does not end with quote")
+		return false
+	}
+	path := self.params.content[1 : 1+end]
+	self.advance(end + 2)
+
+	self.trim_space()
+	if !self.expect(kKeyValEnd) {
+		self.errorf("include does not end with semicolon")
+		return false
+	}
+	self.advance(1)
+
+	self.includes = append(self.includes, include{path: path, line: line, token: len(self.tokens)})
+	return true
+}
+
+// ParseFileWithIncludes is like ParseFile, but the top-level directive
+// include "path"; splices the key-values of the file at path, relative to
+// the including file, where the directive is. Included files may include
+// others, but not in a cycle. A key defined both in a file and in a file
+// it includes is an error, unless Flags.AllowDuplicateKeys is set, in which
+// case the definition that comes last wins, as within a file. Tables
+// defined in both are merged key by key, like tables extended by dotted
+// keys. Anonymous sections are numbered across all the files.
+func ParseFileWithIncludes(path string, flags Flags) (Table, error) {
+	if err := flags.check(); err != nil {
+		return nil, err
+	}
+	in := includer{flags: flags}
+	p, err := in.parse(path)
+	if err != nil {
+		return nil, err
+	}
+	return p.table, nil
+}
+
+// includer parses a file and the files it includes.
+type includer struct {
+	flags Flags
+
+	// stack holds the absolute paths of the files being parsed, each
+	// included by the one before
+	stack []string
+
+	// anonymous is the number of anonymous sections in the files parsed
+	// so far
+	anonymous int
+}
+
+// parse parses the file at path, splicing the files it includes, and
+// returns the parser holding the result.
+func (self *includer) parse(path string) (*parser, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if i := slices.Index(self.stack, abs); i != -1 {
+		cycle := append(slices.Clone(self.stack[i:]), abs)
+		return nil, fmt.Errorf("include cycle: %s", strings.Join(cycle, " -> "))
+	}
+	self.stack = append(self.stack, abs)
+	defer func() { self.stack = self.stack[:len(self.stack)-1] }()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	s := new_scanner(path, string(data), self.flags)
+	s.allow_includes = true
+	if !s.run() {
+		return nil, s.err
+	}
+
+	p := new_parser(path, string(data), self.flags, s.tokens)
+	p.anonymous = self.anonymous
+	p.includes = s.includes
+	// origin holds the file each included key comes from
+	origin := make(map[string]string)
+	p.splice = func(inc include) error {
+		incPath := inc.path
+		if !filepath.IsAbs(incPath) {
+			incPath = filepath.Join(filepath.Dir(path), incPath)
+		}
+		self.anonymous = p.anonymous
+		sub, err := self.parse(incPath)
+		if err != nil {
+			return fmt.Errorf("%s:%d: include '%s': %w", path, inc.line, inc.path, err)
+		}
+		p.anonymous = self.anonymous
+		m := merger{flags: self.flags, file: incPath, origin: origin, def: path}
+		for _, kv := range sub.table {
+			if p.synthetic[kv.Key] || sub.synthetic[kv.Key] {
+				if i := p.table.index_of(kv.Key, false); i != -1 {
+					return fmt.Errorf("%s: key '%s' clashes with the synthetic key of an anonymous section", incPath, kv.Key)
+				}
+			}
+			if p.table, err = m.put(p.table, kv, ""); err != nil {
+				return err
+			}
+		}
+		for key := range sub.synthetic {
+			if p.synthetic == nil {
+				p.synthetic = make(map[string]bool)
+			}
+			p.synthetic[key] = true
+		}
+		return nil
+	}
+	if _, err := p.parse(); err != nil {
+		return nil, err
+	}
+	self.anonymous = p.anonymous
+	return p, nil
+}
+
+// merger adds the key-values of an included file to the table of the file
+// including it, remembering which file each key comes from.
+type merger struct {
+	flags  Flags
+	file   string
+	origin map[string]string
+
+	// def is where the keys missing from origin come from, the including
+	// file
+	def string
+}
+
+// put adds kv to t, where prefix is the dotted path of t, ending with a
+// dot unless empty.
+func (self *merger) put(t Table, kv KeyValue, prefix string) (Table, error) {
+	fold := self.flags.CaseInsensitiveKeys
+	i := t.index_of(kv.Key, fold)
+	if i == -1 {
+		self.origin[prefix+kv.Key] = self.file
+		return append(t, kv), nil
+	}
+	prev := t[i]
+	name := prefix + prev.Key
+	if prev.Value.Kind == ValueKindTable && kv.Value.Kind == ValueKindTable {
+		sub := prev.Value.Data.Table
+		for _, x := range kv.Value.Data.Table {
+			var err error
+			if sub, err = self.put(sub, x, name+"."); err != nil {
+				return nil, err
+			}
+		}
+		t[i].Value.Data.Table = sub
+		return t, nil
+	}
+	if !self.flags.AllowDuplicateKeys {
+		return nil, fmt.Errorf("%s: key '%s' is already defined in %s", self.file, name, self.origin_of(name))
+	}
+	t[i] = kv
+	self.origin[name] = self.file
+	return t, nil
+}
+
+// origin_of returns the file the key name comes from, which is the one its
+// closest parent comes from if it was added with it.
+func (self *merger) origin_of(name string) string {
+	for {
+		if file, ok := self.origin[name]; ok {
+			return file
+		}
+		i := strings.LastIndexByte(name, '.')
+		if i == -1 {
+			return self.def
+		}
+		name = name[:i]
+	}
+}
+
+// splice_includes gives to splice the include directives found before the
+// current token.
+func (self *parser) splice_includes() error {
+	for len(self.includes) != 0 && self.includes[0].token <= self.i {
+		inc := self.includes[0]
+		self.includes = self.includes[1:]
+		if err := self.splice(inc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
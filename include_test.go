@@ -0,0 +1,152 @@
+package kevs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestParseFileWithIncludes(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.kevs": `
+name = "app";
+include "conf/common.kevs";
+port = 8080;
+include  "conf/empty.kevs" ;
+`,
+		"conf/common.kevs": `
+# shared settings
+include "db.kevs";
+timeout = 5;
+`,
+		"conf/db.kevs":    `db = { host = "h"; };`,
+		"conf/empty.kevs": ``,
+	})
+
+	root, err := ParseFileWithIncludes(filepath.Join(dir, "main.kevs"), Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustParse(t, `name = "app"; db = { host = "h"; }; timeout = 5; port = 8080;`)
+	if !root.Equal(want) {
+		t.Fatalf("unexpected table: %v", root)
+	}
+
+	// without includes, the directive is an error
+	if _, err := ParseFile(filepath.Join(dir, "main.kevs"), Flags{}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestParseFileWithIncludesErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.kevs":       `x = 1; include "b.kevs";`,
+		"b.kevs":       `include "a.kevs";`,
+		"dup.kevs":     "x = 1;\ninclude \"other.kevs\";\n",
+		"other.kevs":   `y = 1; x = 2;`,
+		"nested.kevs":  "t = {\n    include \"other.kevs\";\n};\n",
+		"missing.kevs": `include "nope.kevs";`,
+		"bad.kevs":     `include "other.kevs"`,
+	})
+
+	tests := []struct {
+		file string
+		err  string
+	}{
+		{"a.kevs", "include cycle: "},
+		{"dup.kevs", "other.kevs: key 'x' is already defined in "},
+		{"nested.kevs", "nested.kevs:2:5: error: scan: "},
+		{"missing.kevs", "include 'nope.kevs': read config: "},
+		{"bad.kevs", "include does not end with semicolon"},
+	}
+	for _, test := range tests {
+		_, err := ParseFileWithIncludes(filepath.Join(dir, test.file), Flags{})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: want error containing %q, have %v", test.file, test.err, err)
+		}
+	}
+
+	// the later definition wins, as within a file
+	root, err := ParseFileWithIncludes(filepath.Join(dir, "dup.kevs"), Flags{AllowDuplicateKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equal(mustParse(t, "x = 2; y = 1;")) {
+		t.Fatalf("unexpected table: %v", root)
+	}
+}
+
+func TestParseFileWithIncludesSplice(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"line.kevs":    `x = 1; include "y.kevs"; z = 3;`,
+		"y.kevs":       `y = 2;`,
+		"nested.kevs":  "server.host = \"h\";\ninclude \"port.kevs\";\nserver.tls = true;\n",
+		"port.kevs":    `server = { port = 80; };`,
+		"clash.kevs":   "server.port = 81;\ninclude \"port.kevs\";\n",
+		"records.kevs": "{ id = 1; }\ninclude \"record.kevs\";\n{ id = 3; }\n",
+		"record.kevs":  "{ id = 2; }\n",
+		"synth.kevs":   "{ id = 1; }\n_1 = 5;\ninclude \"record.kevs\";\n",
+		"ref.kevs":     "include \"y.kevs\";\nz = @y;\n",
+	})
+
+	tests := []struct {
+		file  string
+		flags Flags
+		want  string
+	}{
+		{"line.kevs", Flags{}, "x = 1; y = 2; z = 3;"},
+		{"nested.kevs", Flags{}, `server = { host = "h"; port = 80; tls = true; };`},
+		{"records.kevs", Flags{AnonymousSections: true}, "_0 = { id = 1; }; _1 = { id = 2; }; _2 = { id = 3; };"},
+		{"ref.kevs", Flags{AllowReferences: true}, "y = 2; z = 2;"},
+	}
+	for _, test := range tests {
+		root, err := ParseFileWithIncludes(filepath.Join(dir, test.file), test.flags)
+		if err != nil {
+			t.Fatalf("%s: %v", test.file, err)
+		}
+		if want := mustParse(t, test.want); !root.Equal(want) {
+			t.Fatalf("%s: unexpected table: %v", test.file, root)
+		}
+	}
+
+	errs := []struct {
+		file  string
+		flags Flags
+		err   string
+	}{
+		{"clash.kevs", Flags{}, "port.kevs: key 'server.port' is already defined in "},
+		{"synth.kevs", Flags{AnonymousSections: true}, "record.kevs: key '_1' clashes with the synthetic key of an anonymous section"},
+		{"synth.kevs", Flags{AnonymousSections: true, AllowDuplicateKeys: true}, "key '_1' clashes with the synthetic key"},
+	}
+	for _, test := range errs {
+		_, err := ParseFileWithIncludes(filepath.Join(dir, test.file), test.flags)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: want error containing %q, have %v", test.file, test.err, err)
+		}
+	}
+
+	// the later definition wins, in nested tables too
+	root, err := ParseFileWithIncludes(filepath.Join(dir, "clash.kevs"), Flags{AllowDuplicateKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equal(mustParse(t, "server = { port = 80; };")) {
+		t.Fatalf("unexpected table: %v", root)
+	}
+}
@@ -0,0 +1,207 @@
+package kevs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// FromJSON builds a table from a JSON object, keeping the order of its keys.
+// Numbers with a fraction or an exponent become floats, even if whole, and
+// the others integers, or floats if they do not fit in 64 bits. The keys
+// must be valid identifiers and unique. Arrays and objects can be nested
+// up to the default of Flags.MaxDepth.
+func FromJSON(data []byte) (Table, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	tok, err := d.Token()
+	if err != nil {
+		return nil, fmt.Errorf("json: %w", err)
+	}
+	if tok != json.Delim('{') {
+		return nil, errors.New("json: top-level value is not an object")
+	}
+	t, err := json_table(d, 0)
+	if err != nil {
+		return nil, fmt.Errorf("json: %w", err)
+	}
+	if _, err := d.Token(); !errors.Is(err, io.EOF) {
+		return nil, errors.New("json: unexpected data after top-level object")
+	}
+	return t, nil
+}
+
+// json_table reads the rest of an object, after its '{', nested in depth
+// arrays and objects below the top-level one.
+func json_table(d *json.Decoder, depth int) (Table, error) {
+	out := Table{}
+	for d.More() {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := tok.(string) //nolint:forcetypeassert // object keys are strings
+		if !is_identifier(key) {
+			return nil, fmt.Errorf("key '%s' is not a valid identifier", key)
+		}
+		if _, found := out.Get(key); found {
+			return nil, fmt.Errorf("key '%s' is not unique", key)
+		}
+		v, err := json_value(d, depth)
+		if err != nil {
+			return nil, fmt.Errorf("key '%s': %w", key, err)
+		}
+		out = append(out, KeyValue{Key: key, Value: v})
+	}
+	// the closing '}'
+	if _, err := d.Token(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func json_value(d *json.Decoder, depth int) (Value, error) {
+	tok, err := d.Token()
+	if err != nil {
+		return Value{}, err
+	}
+	switch tok := tok.(type) {
+	case json.Delim:
+		if depth++; depth > defaultMaxDepth {
+			return Value{}, errors.New("maximum nesting depth exceeded")
+		}
+		if tok == '{' {
+			t, err := json_table(d, depth)
+			if err != nil {
+				return Value{}, err
+			}
+			return TableValue(t), nil
+		}
+		l := List{}
+		for d.More() {
+			item, err := json_value(d, depth)
+			if err != nil {
+				return Value{}, fmt.Errorf("element %d: %w", len(l), err)
+			}
+			l = append(l, item)
+		}
+		// the closing ']'
+		if _, err := d.Token(); err != nil {
+			return Value{}, err
+		}
+		return ListValue(l...), nil
+
+	case string:
+		return StringValue(tok), nil
+
+	case bool:
+		return BooleanValue(tok), nil
+
+	case nil:
+		return NullValue(), nil
+
+	default:
+		return json_number(tok.(json.Number)) //nolint:forcetypeassert // UseNumber is set
+	}
+}
+
+func json_number(n json.Number) (Value, error) {
+	s := string(n)
+	if !strings.ContainsAny(s, ".eE") {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return IntegerValue(i), nil
+		}
+		if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return Value{Kind: ValueKindInteger, Data: ValueData{Uint: u}}, nil
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return Value{}, fmt.Errorf("number %s is out of range", s)
+	}
+	return FloatValue(f), nil
+}
+
+// MarshalJSON implements json.Marshaler: tables become objects, lists
+// arrays and scalars their JSON equivalents. Keys are written in table
+// order, but JSON objects are unordered, so consumers may not keep it.
+func (self Table) MarshalJSON() ([]byte, error) {
+	var dst bytes.Buffer
+	if err := write_json_table(&dst, self); err != nil {
+		return nil, err
+	}
+	return dst.Bytes(), nil
+}
+
+func write_json_table(dst *bytes.Buffer, t Table) error {
+	dst.WriteByte('{')
+	for i, kv := range t {
+		if i > 0 {
+			dst.WriteByte(',')
+		}
+		write_json_string(dst, kv.Key)
+		dst.WriteByte(':')
+		if err := write_json_value(dst, kv.Value); err != nil {
+			return fmt.Errorf("key '%s': %w", kv.Key, err)
+		}
+	}
+	dst.WriteByte('}')
+	return nil
+}
+
+func write_json_value(dst *bytes.Buffer, v Value) error {
+	switch v.Kind {
+	case ValueKindString:
+		write_json_string(dst, v.Data.String)
+
+	case ValueKindInteger:
+		dst.WriteString(v.FormatInteger(10))
+
+	case ValueKindFloat:
+		if math.IsInf(v.Data.Float, 0) || math.IsNaN(v.Data.Float) {
+			return fmt.Errorf("cannot encode float %v", v.Data.Float)
+		}
+		// keep whole floats apart from integers, for FromJSON
+		dst.WriteString(format_float(v.Data.Float))
+
+	case ValueKindBoolean:
+		dst.WriteString(strconv.FormatBool(v.Data.Boolean))
+
+	case ValueKindNull:
+		dst.WriteString("null")
+
+	case ValueKindList:
+		dst.WriteByte('[')
+		for i, item := range v.Data.List {
+			if i > 0 {
+				dst.WriteByte(',')
+			}
+			if err := write_json_value(dst, item); err != nil {
+				return fmt.Errorf("element %d: %w", i, err)
+			}
+		}
+		dst.WriteByte(']')
+
+	case ValueKindTable:
+		return write_json_table(dst, v.Data.Table)
+
+	default:
+		return fmt.Errorf("cannot encode value of kind %s", v.Kind)
+	}
+	return nil
+}
+
+// write_json_string writes s quoted, without the HTML escaping done by
+// json.Marshal.
+func write_json_string(dst *bytes.Buffer, s string) {
+	e := json.NewEncoder(dst)
+	e.SetEscapeHTML(false)
+	_ = e.Encode(s) // strings always encode
+	// drop the newline added by Encode
+	dst.Truncate(dst.Len() - 1)
+}
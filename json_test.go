@@ -0,0 +1,156 @@
+package kevs
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestMarshalJSON(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{``, `{}`},
+		{`s = "a\"b<\n";`, `{"s":"a\"b<\n"}`},
+		{`i = -42; h = 0xff; u = 18446744073709551615;`, `{"i":-42,"h":255,"u":18446744073709551615}`},
+		{`f = 2.5e-3; g = 1e6; w = 3.0;`, `{"f":0.0025,"g":1e+06,"w":3.0}`},
+		{`t = true; f = false; n = null;`, `{"t":true,"f":false,"n":null}`},
+		{`l = []; t = {};`, `{"l":[],"t":{}}`},
+		{
+			`z = { b = [ 1; { c = "x"; }; [ true; ]; ]; a = {}; };`,
+			`{"z":{"b":[1,{"c":"x"},[true]],"a":{}}}`,
+		},
+	}
+	for _, test := range tests {
+		root := mustParse(t, test.in)
+		out, err := root.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != test.out {
+			t.Errorf("want %s, have %s", test.out, out)
+		}
+		if !json.Valid(out) {
+			t.Errorf("%s: invalid JSON", out)
+		}
+	}
+
+	// json.Marshal uses MarshalJSON, also for nested tables
+	out, err := json.Marshal(map[string]Table{"x": mustParse(t, "a = 1;")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"x":{"a":1}}` {
+		t.Fatalf("unexpected output: %s", out)
+	}
+
+	invalid := []Table{
+		{{Key: "u", Value: Value{}}},
+		{{Key: "f", Value: FloatValue(math.NaN())}},
+		{{Key: "l", Value: ListValue(FloatValue(math.Inf(-1)))}},
+	}
+	for _, root := range invalid {
+		if _, err := root.MarshalJSON(); err == nil {
+			t.Errorf("%v: expected error", root)
+		}
+	}
+}
+
+func TestFromJSON(t *testing.T) {
+	doc := `{"name":"app","port":8080,"ratio":0.5,"whole":3.0,"exp":1e+06,"neg":-1,"big":18446744073709551615,"huge":1e+300,` +
+		`"debug":false,"none":null,"empty":{},"list":[],` +
+		`"servers":[{"host":"a","tags":[["x"],[]]},{"host":"b","opts":{"tls":true,"ports":[1,2]}}]}`
+
+	root, err := FromJSON([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := mustParse(t, `
+name = "app";
+port = 8080;
+ratio = 0.5;
+whole = 3.0;
+exp = 1e6;
+neg = -1;
+big = 18446744073709551615;
+huge = 1e300;
+debug = false;
+none = null;
+empty = {};
+list = [];
+servers = [
+    { host = "a"; tags = [ [ "x"; ]; []; ]; };
+    { host = "b"; opts = { tls = true; ports = [ 1; 2; ]; }; };
+];
+`)
+	if !root.Equal(want) {
+		t.Fatalf("unexpected table: %v", root)
+	}
+
+	out, err := root.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != doc {
+		t.Fatalf("round-trip:\nwant %s\nhave %s", doc, out)
+	}
+
+	root, err = FromJSON([]byte(`{"n": 123456789012345678901234567890}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := root.Get("n"); v.Kind != ValueKindFloat {
+		t.Fatalf("unexpected value: %v", v)
+	}
+
+	invalid := []string{
+		``,
+		`[]`,
+		`"x"`,
+		`{"a":1}{}`,
+		`{"a":1,"a":2}`,
+		`{"log-level":1}`,
+		`{"a":{"b":[1,{"":2}]}}`,
+		`{"a":1e400}`,
+		`{"a":[1,}`,
+		`{"a":`,
+	}
+	for _, data := range invalid {
+		if _, err := FromJSON([]byte(data)); err == nil {
+			t.Errorf("%s: expected error", data)
+		}
+	}
+}
+
+func TestFromJSONMaxDepth(t *testing.T) {
+	nested := func(n int) string {
+		return `{"a":` + strings.Repeat("[", n) + "1" + strings.Repeat("]", n) + "}"
+	}
+
+	root, err := FromJSON([]byte(nested(128)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same limit as the parser
+	out, err := Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Parse("none", string(out), Flags{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []int{129, 100000} {
+		_, err := FromJSON([]byte(nested(n)))
+		if err == nil || !strings.HasSuffix(err.Error(), "maximum nesting depth exceeded") {
+			t.Fatalf("%d: unexpected error: %v", n, err)
+		}
+	}
+	_, err = FromJSON([]byte(`{"a":` + strings.Repeat(`{"a":`, 129) + "1" + strings.Repeat("}", 130)))
+	if err == nil || !strings.HasSuffix(err.Error(), "maximum nesting depth exceeded") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
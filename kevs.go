@@ -3,8 +3,17 @@ package kevs
 import (
 	"errors"
 	"fmt"
+	"io"
+	"iter"
+	"math"
+	"os"
+	"path"
 	"reflect"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 type ValueKind uint8
@@ -16,6 +25,16 @@ const (
 	ValueKindBoolean
 	ValueKindList
 	ValueKindTable
+
+	// ValueKindNull is the kind of the bareword null, an explicit "no
+	// value", as opposed to a missing key. With Flags.AllowDuplicateKeys a
+	// later null replaces an earlier value, it does not remove the key.
+	ValueKindNull
+
+	// ValueKindFloat is the kind of decimal numbers written with a fraction
+	// or an exponent, e.g. 2.5, 1e6 or 2.5e-3. Hexadecimal floats, e.g.
+	// 0x1p4, are not supported.
+	ValueKindFloat
 )
 
 func (self ValueKind) String() string {
@@ -32,6 +51,10 @@ func (self ValueKind) String() string {
 		return "list"
 	case ValueKindTable:
 		return "table"
+	case ValueKindNull:
+		return "null"
+	case ValueKindFloat:
+		return "float"
 	default:
 		return "unknown"
 	}
@@ -45,26 +68,281 @@ type ValueData struct {
 	String  string
 	Integer int64
 	Boolean bool
+	Float   float64
+
+	// Uint holds the integers above math.MaxInt64, which do not fit in
+	// Integer; Integer is zero for them.
+	Uint uint64
+
+	// Base is the radix an integer was written in: 2, 8 or 16, or zero
+	// for decimal. It is used to write the integer back the same way.
+	Base uint8
 }
 
 type Value struct {
 	Kind ValueKind
 	Data ValueData
+
+	// Comments, Comment and Trailing are as for KeyValue, for the elements
+	// of a list.
+	Comments []string
+	Comment  string
+	Trailing []string
+}
+
+// StringValue returns a string value.
+func StringValue(s string) Value {
+	return Value{Kind: ValueKindString, Data: ValueData{String: s}}
+}
+
+// IntegerValue returns an integer value.
+func IntegerValue(i int64) Value {
+	return Value{Kind: ValueKindInteger, Data: ValueData{Integer: i}}
+}
+
+// FloatValue returns a float value.
+func FloatValue(f float64) Value {
+	return Value{Kind: ValueKindFloat, Data: ValueData{Float: f}}
+}
+
+// BooleanValue returns a boolean value.
+func BooleanValue(b bool) Value {
+	return Value{Kind: ValueKindBoolean, Data: ValueData{Boolean: b}}
+}
+
+// NullValue returns a null value.
+func NullValue() Value {
+	return Value{Kind: ValueKindNull}
+}
+
+// ListValue returns a list value holding items.
+func ListValue(items ...Value) Value {
+	return Value{Kind: ValueKindList, Data: ValueData{List: items}}
+}
+
+// TableValue returns a table value holding t.
+func TableValue(t Table) Value {
+	return Value{Kind: ValueKindTable, Data: ValueData{Table: t}}
 }
 
 type KeyValue struct {
 	Key   string
 	Value Value
+
+	// Line and Column are the position of the key in the input. They are
+	// zero for key-values that were not parsed.
+	Line   int
+	Column int
+
+	// Comments holds the comment lines, their prefix included, found before
+	// the key-value, Comment the one at the end of its last line, e.g.
+	// "# seconds" for timeout = 5; # seconds, and Trailing the comment lines
+	// after the last key-value of a table or of the input. They are only set
+	// when Flags.KeepComments is enabled.
+	Comments []string
+	Comment  string
+	Trailing []string
 }
 
 type Table []KeyValue
 
+// Parse scans and parses content. When Flags.CollectAll is set, the table
+// built from the well-formed key-values is returned together with all the
+// errors, joined.
 func Parse(file, content string, flags Flags) (Table, error) {
+	if err := flags.check(); err != nil {
+		return nil, err
+	}
 	tokens, err := Scan(file, content, flags)
+	if err != nil && !flags.CollectAll {
+		return nil, err
+	}
+	table, perr := ParseTokens(file, content, flags, tokens)
+	if err != nil || perr != nil {
+		return table, errors.Join(err, perr)
+	}
+	return table, nil
+}
+
+// ParseFile reads the file at path and parses it, using path as the file
+// name in error messages.
+func ParseFile(path string, flags Flags) (Table, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	return Parse(path, string(data), flags)
+}
+
+// documentSeparator is a line separating the documents given to ParseAll.
+const documentSeparator = "---"
+
+// ParseAll parses content made of several documents separated by "---"
+// lines, returning one table per document. A separator on the first line
+// does not start an empty document. Line numbers in errors are relative to
+// the whole content. The separator is recognized anywhere, even inside a
+// multi-line raw string. Flags.MaxInputSize and Flags.MaxTokens limit the
+// whole content, not each document.
+func ParseAll(file, content string, flags Flags) ([]Table, error) {
+	if err := flags.check(); err != nil {
+		return nil, err
+	}
+	if err := flags.check_size(file, len(content)); err != nil {
 		return nil, err
 	}
-	return ParseTokens(file, content, flags, tokens)
+
+	var out []Table
+	var errs []error
+
+	// separator lines can end with any newline
+	content = normalize_newlines(strings.TrimPrefix(content, utf8BOM), flags.comment_prefix())
+	docs := split_documents(content)
+	line := 1
+	count := 0
+	for i, doc := range docs {
+		if i > 0 || doc != "" || len(docs) == 1 {
+			s := new_scanner(file, doc, flags)
+			s.line = line
+			s.count = count
+			ok := s.run()
+			count = s.count
+			if !ok && !flags.CollectAll {
+				return nil, s.err
+			}
+			table, err := ParseTokens(file, doc, flags, s.tokens)
+			if s.err != nil || err != nil {
+				if !flags.CollectAll {
+					return nil, err
+				}
+				errs = append(errs, s.err, err)
+			}
+			out = append(out, table)
+		}
+		// skip the document and the separator line after it
+		line += strings.Count(doc, "\n") + 1
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return out, err
+	}
+	return out, nil
+}
+
+// split_documents splits content on separator lines, each document keeping
+// the newline that ends its last line.
+func split_documents(content string) []string {
+	var out []string
+	start := 0
+	for pos := 0; pos < len(content); {
+		end := strings.IndexByte(content[pos:], '\n')
+		if end == -1 {
+			end = len(content)
+		} else {
+			end += pos
+		}
+		if strings.Trim(content[pos:end], spaces) == documentSeparator {
+			out = append(out, content[start:pos])
+			start = min(end+1, len(content))
+		}
+		pos = end + 1
+	}
+	return append(out, content[start:])
+}
+
+// ParseStats holds information gathered while parsing.
+type ParseStats struct {
+	// CommentCount is the number of comments found in the input.
+	// An empty table with a non-zero CommentCount usually means that
+	// the whole config was commented out.
+	CommentCount int
+}
+
+// ParseWithStats is like Parse but also returns statistics about the input.
+func ParseWithStats(file, content string, flags Flags) (Table, ParseStats, error) {
+	if err := flags.check(); err != nil {
+		return nil, ParseStats{}, err
+	}
+	s := new_scanner(file, content, flags)
+	if !s.run() && !flags.CollectAll {
+		return nil, ParseStats{}, s.err
+	}
+	stats := ParseStats{
+		CommentCount: s.comments,
+	}
+	table, err := ParseTokens(file, content, flags, s.tokens)
+	if s.err != nil || err != nil {
+		return table, stats, errors.Join(s.err, err)
+	}
+	return table, stats, nil
+}
+
+// Error is a scan or parse error at a position in the input.
+type Error struct {
+	File    string
+	Line    int    // zero if the error has no position
+	Column  int    // zero if the error has no column
+	Stage   string // "scan" or "parse"
+	Message string
+}
+
+func (self *Error) Error() string {
+	if self.Line == 0 {
+		return fmt.Sprintf("%s: error: %s: %s", self.File, self.Stage, self.Message)
+	}
+	if self.Column != 0 {
+		return fmt.Sprintf("%s:%d:%d: error: %s: %s", self.File, self.Line, self.Column, self.Stage, self.Message)
+	}
+	return fmt.Sprintf("%s:%d: error: %s: %s", self.File, self.Line, self.Stage, self.Message)
+}
+
+// Diagnostic is a machine-readable report of a problem found in the input,
+// meant for editor and CI integration.
+type Diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// ParseDiagnostics is like Parse but reports errors as diagnostics.
+func ParseDiagnostics(file, content string, flags Flags) (Table, []Diagnostic) {
+	table, err := Parse(file, content, flags)
+	if err == nil {
+		return table, nil
+	}
+
+	var out []Diagnostic
+	for _, err := range flatten_errors(err) {
+		d := Diagnostic{
+			File:     file,
+			Severity: "error",
+			Message:  err.Error(),
+		}
+		var e *Error
+		if errors.As(err, &e) {
+			d.File = e.File
+			d.Line = e.Line
+			d.Column = e.Column
+			d.Message = e.Message
+		}
+		out = append(out, d)
+	}
+
+	return table, out
+}
+
+// flatten_errors returns the errors joined in err, recursively.
+func flatten_errors(err error) []error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+	var out []error
+	for _, err := range joined.Unwrap() {
+		out = append(out, flatten_errors(err)...)
+	}
+	return out
 }
 
 type TokenKind uint8
@@ -74,6 +352,7 @@ const (
 	TokenKindKey
 	TokenKindDelim
 	TokenKindValue
+	TokenKindComment
 )
 
 func (self TokenKind) String() string {
@@ -86,19 +365,164 @@ func (self TokenKind) String() string {
 		return "delim"
 	case TokenKindValue:
 		return "value"
+	case TokenKindComment:
+		return "comment"
 	default:
 		return "unknown"
 	}
 }
 
 type Token struct {
-	Value string
-	Kind  TokenKind
-	Line  int
+	Value  string
+	Kind   TokenKind
+	Line   int
+	Column int
+
+	// Space holds the whitespace preceding the token on its line,
+	// it is only set when Flags.KeepSpace is enabled.
+	Space string
 }
 
 type Flags struct {
 	AbortOnError bool
+
+	// AnonymousSections allows top-level tables and lists without a key,
+	// e.g. a stream of records. They are given the synthetic keys _0, _1,
+	// etc. in order of appearance and their terminating semicolon is
+	// optional. A real key equal to a synthetic one is an error, even with
+	// AllowDuplicateKeys.
+	AnonymousSections bool
+
+	// KeepSpace makes the scanner record in Token.Space the whitespace
+	// found before each token, so that formatters can inspect it.
+	KeepSpace bool
+
+	// IdentifierFunc, if set, replaces the built-in validation of keys. It is
+	// called for each part of a dotted key.
+	IdentifierFunc func(s string) bool
+
+	// StrictRawStrings rejects raw strings that contain control characters
+	// other than newline and tab.
+	StrictRawStrings bool
+
+	// CollectAll makes scanning and parsing continue after an error, so
+	// that all the errors in the input are reported at once. It cannot be
+	// combined with AbortOnError.
+	CollectAll bool
+
+	// MaxStringLength limits the length in bytes of string values,
+	// quotes excluded. Zero means unlimited.
+	MaxStringLength int
+
+	// KeepComments makes the scanner emit comments as tokens instead of
+	// dropping them, and the parser attach them to the key-values and list
+	// elements, see KeyValue.Comments, so that Marshal writes them back.
+	// Only the comments of a table, list or input without any key-value or
+	// element are dropped, as there is nothing to attach them to.
+	KeepComments bool
+
+	// AllowDuplicateKeys makes a key defined again in the same table
+	// replace the earlier definition, in place. Without it duplicate keys
+	// are an error.
+	AllowDuplicateKeys bool
+
+	// ExpandEnv replaces ${NAME} in string values with the value of the
+	// environment variable NAME, which must be set, and ${NAME:-default}
+	// with default if NAME is unset or empty. Raw strings are not expanded.
+	ExpandEnv bool
+
+	// MaxDepth limits the nesting of lists and tables, to protect against
+	// stack exhaustion on untrusted input. Zero means the default of 128,
+	// a negative value means unlimited.
+	MaxDepth int
+
+	// MaxInputSize limits the size in bytes of the input and MaxTokens the
+	// number of tokens scanned from it, to protect against memory
+	// exhaustion on untrusted input. Zero means unlimited.
+	MaxInputSize int
+	MaxTokens    int
+
+	// CaseInsensitiveKeys makes keys differing only in ASCII case
+	// duplicates of each other. Use Table.GetFold to look them up.
+	CaseInsensitiveKeys bool
+
+	// DedentRawStrings removes from raw strings and heredocs the
+	// indentation common to their lines, see dedent.
+	DedentRawStrings bool
+
+	// AllowTrailingContent ignores the content after the last key-value
+	// which doesn't form a key-value, e.g. a stray delimiter or some text.
+	// Without it such content is an error.
+	AllowTrailingContent bool
+
+	// CommentPrefix is the text comments start with, e.g. "//". Empty
+	// means the default of "#". It cannot start with a space, with a
+	// character which has a meaning of its own, like ';', the value
+	// terminator, or with one that can start a key or a value, like a
+	// letter, a digit or '-'.
+	CommentPrefix string
+
+	// AllowReferences makes a value @path, e.g. @base or @servers.0.host,
+	// a copy of the value at path, see Table.GetPath. The path starts at the
+	// top-level table and must refer to a value defined before, which can
+	// be in a table still being defined, like @t.x in t = { x = 1; y = @t.x; };.
+	// Forward references and references to a value being defined, which
+	// would be cycles, are errors, except with AllowDuplicateKeys for a key
+	// defined again, which refers to its earlier definition. The copies
+	// can hold at most 1<<20 values in all, to protect against the input
+	// which doubles a list at each reference.
+	AllowReferences bool
+}
+
+const defaultMaxDepth = 128
+
+// maxReferenceValues limits the number of values copied by references.
+const maxReferenceValues = 1 << 20
+
+func (self Flags) max_depth() int {
+	if self.MaxDepth == 0 {
+		return defaultMaxDepth
+	}
+	return self.MaxDepth
+}
+
+func (self Flags) check() error {
+	if self.AbortOnError && self.CollectAll {
+		return errors.New("flags AbortOnError and CollectAll are mutually exclusive")
+	}
+	if p := self.CommentPrefix; p != "" && (strings.ContainsAny(p[:1], reservedCommentChars) || starts_value(p[0])) {
+		return fmt.Errorf("flag CommentPrefix cannot start with '%c'", p[0])
+	}
+	return nil
+}
+
+// check_size fails if an input of size bytes exceeds Flags.MaxInputSize.
+func (self Flags) check_size(file string, size int) error {
+	if max := self.MaxInputSize; max > 0 && size > max {
+		return &Error{
+			File:    file,
+			Stage:   "scan",
+			Message: fmt.Sprintf("input size %d exceeds maximum of %d", size, max),
+		}
+	}
+	return nil
+}
+
+// reservedCommentChars can't start a comment prefix, as they start or end
+// something else.
+const reservedCommentChars = "=;\"`[]{}<\n\r" + spaces
+
+// starts_value reports whether c can start a key or a bare value, e.g. the
+// 'R' of REMOTE or the '-' of -1, which a comment prefix would swallow.
+func starts_value(c byte) bool {
+	return is_letter(c) || is_digit(c) || strings.IndexByte("_-+.@", c) != -1
+}
+
+func (self Flags) comment_prefix() string {
+	if self.CommentPrefix == "" {
+		return string(kCommentBegin)
+	}
+	return self.CommentPrefix
 }
 
 type params struct {
@@ -108,10 +532,22 @@ type params struct {
 }
 
 type scanner struct {
-	params params
-	tokens []Token
-	line   int
-	err    error
+	params    params
+	tokens    []Token
+	line      int
+	column    int
+	comments  int
+	anonymous int
+	space     string
+	err       error
+	errs      []error // collected in CollectAll mode
+	depth     int
+	count     int  // number of tokens scanned, including dropped ones
+	fatal     bool // the error stops scanning even in CollectAll mode
+
+	// include directives are only recognized for ParseFileWithIncludes
+	allow_includes bool
+	includes       []include
 }
 
 const (
@@ -124,41 +560,340 @@ const (
 	kListEnd        = ']'
 	kTableBegin     = '{'
 	kTableEnd       = '}'
+	kHeredocBegin   = "<<"
 
 	spaces = " \t"
+
+	utf8BOM = "\xef\xbb\xbf"
 )
 
+// Scan splits content into tokens. When Flags.CollectAll is set, the tokens
+// of the well-formed key-values are returned together with all the errors,
+// joined.
 func Scan(file, content string, flags Flags) ([]Token, error) {
-	s := scanner{
+	return ScanInto(file, content, flags, nil)
+}
+
+// ScanInto is like Scan, but appends the tokens to buf[:0], so that a buffer
+// can be reused between calls, e.g. through a sync.Pool. On error, unless
+// Flags.CollectAll is set, the returned slice is nil; buf may still have
+// been written to.
+func ScanInto(file, content string, flags Flags, buf []Token) ([]Token, error) {
+	ts := NewScanner(file, content, flags)
+	tokens := buf[:0]
+	for tok, ok := ts.Next(); ok; tok, ok = ts.Next() {
+		tokens = append(tokens, tok)
+	}
+	if err := ts.Err(); err != nil {
+		if flags.CollectAll {
+			return tokens, err
+		}
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// TokenScanner produces the tokens of the input incrementally, scanning one
+// top-level key-value at a time, so that only the tokens of the current
+// key-value are held in memory.
+type TokenScanner struct {
+	s    *scanner
+	next int
+	done bool
+}
+
+// NewScanner returns a TokenScanner for content.
+func NewScanner(file, content string, flags Flags) *TokenScanner {
+	ts := &TokenScanner{
+		s: new_scanner(file, content, flags),
+	}
+	if !ts.s.start() {
+		ts.done = true
+	}
+	return ts
+}
+
+// Next returns the next token, or false when there are no more tokens,
+// either at the end of the input or after an error, reported by Err.
+// When Flags.CollectAll is set, scanning continues after errors and the
+// tokens of the malformed key-values are skipped.
+func (self *TokenScanner) Next() (Token, bool) {
+	for self.next == len(self.s.tokens) {
+		if self.done {
+			return Token{}, false
+		}
+		// the tokens returned so far are no longer needed
+		self.s.tokens = self.s.tokens[:0]
+		self.next = 0
+		if len(self.s.params.content) == 0 {
+			self.s.finish()
+			self.done = true
+		} else if !self.s.step() {
+			self.done = true
+		}
+	}
+	tok := self.s.tokens[self.next]
+	self.next++
+	return tok, true
+}
+
+// Err returns the error that stopped the scanning, or, when
+// Flags.CollectAll is set, all the errors found, joined.
+func (self *TokenScanner) Err() error {
+	return self.s.err
+}
+
+func new_scanner(file, content string, flags Flags) *scanner {
+	return &scanner{
 		params: params{
 			file:    file,
 			content: content,
 			flags:   flags,
 		},
-		line: 1,
+		line:   1,
+		column: 1,
+	}
+}
+
+func (self *scanner) run() bool {
+	if !self.start() {
+		return false
+	}
+
+	for len(self.params.content) != 0 {
+		if !self.step() {
+			return false
+		}
+	}
+	return self.finish()
+}
+
+// start checks the flags and the input before scanning.
+func (self *scanner) start() bool {
+	if err := self.params.flags.check(); err != nil {
+		self.err = err
+		return false
+	}
+	if err := self.params.flags.check_size(self.params.file, len(self.params.content)); err != nil {
+		self.err = err
+		return false
 	}
+	// editors on Windows may start files with a byte order mark
+	self.params.content = strings.TrimPrefix(self.params.content, utf8BOM)
+	self.params.content = normalize_newlines(self.params.content, self.params.flags.comment_prefix())
+	return true
+}
 
-	for len(s.params.content) != 0 {
-		s.trim_space()
-		ok := false
+// normalize_newlines turns CRLF and lone CR line endings into LF, so that
+// the rest of the scanner only deals with '\n'. A CR inside a quoted string
+// is part of its value and is kept. The quoted strings are found as the
+// scanner does, past the comments, which start with prefix, the raw strings
+// and the heredocs, whose line endings are normalized.
+func normalize_newlines(s, prefix string) string {
+	if !strings.Contains(s, "\r") {
+		return s
+	}
+	var dst strings.Builder
+	dst.Grow(len(s))
+	for i := 0; i < len(s); {
+		end := -1
 		switch {
-		case s.expect('\n'):
-			ok = s.scan_newline()
-		case s.expect(kCommentBegin):
-			ok = s.scan_comment()
-		default:
-			ok = s.scan_key_value()
+		case s[i] == kStringBegin:
+			end = quoted_string_end(s[i:])
+			dst.WriteString(s[i : i+end])
+			i += end
+			continue
+		case s[i] == kRawStringBegin:
+			end = len(s) - i
+			if j := strings.IndexByte(s[i+1:], kRawStringBegin); j != -1 {
+				end = j + 2
+			}
+		case strings.HasPrefix(s[i:], kHeredocBegin):
+			end = heredoc_end(s[i:])
+		case strings.HasPrefix(s[i:], prefix):
+			end, _ = line_end(s[i:])
 		}
-		if !ok {
-			return nil, s.err
+		if end > 0 {
+			chunk := strings.ReplaceAll(s[i:i+end], "\r\n", "\n")
+			dst.WriteString(strings.ReplaceAll(chunk, "\r", "\n"))
+			i += end
+			continue
+		}
+		if s[i] == '\r' {
+			dst.WriteByte('\n')
+			if i+1 < len(s) && s[i+1] == '\n' {
+				i++
+			}
+		} else {
+			dst.WriteByte(s[i])
+		}
+		i++
+	}
+	return dst.String()
+}
+
+// quoted_string_end returns the length of the quoted string s starts with,
+// or len(s) if it does not end, like scan_string_value.
+func quoted_string_end(s string) int {
+	for i := 1; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+		} else if s[i] == kStringBegin {
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+// heredoc_end returns the length of the heredoc s starts with, up to its
+// closing marker, or len(s) if it does not end, like scan_heredoc.
+func heredoc_end(s string) int {
+	end, next := line_end(s)
+	marker := strings.TrimRight(s[len(kHeredocBegin):end], spaces)
+	for start := next; start < len(s); start = next {
+		end, next = line_end(s[start:])
+		end, next = start+end, start+next
+		trimmed := strings.TrimLeft(s[start:end], spaces)
+		if rest, ok := strings.CutPrefix(trimmed, marker); ok && strings.HasPrefix(strings.TrimLeft(rest, spaces), string(kKeyValEnd)) {
+			return end - len(rest)
 		}
 	}
+	return len(s)
+}
+
+// line_end returns the end of the first line of s and the start of the next
+// one, past a LF, a CRLF or a lone CR.
+func line_end(s string) (int, int) {
+	end := strings.IndexAny(s, "\r\n")
+	switch {
+	case end == -1:
+		return len(s), len(s)
+	case strings.HasPrefix(s[end:], "\r\n"):
+		return end, end + 2
+	default:
+		return end, end + 1
+	}
+}
+
+// check_tokens fails if more than Flags.MaxTokens tokens were scanned.
+func (self *scanner) check_tokens() bool {
+	if max := self.params.flags.MaxTokens; max > 0 && self.count > max {
+		self.errorf("maximum number of tokens exceeded")
+		self.fatal = true
+		return false
+	}
+	return true
+}
+
+// step scans the next top-level item. On error, the tokens of the item are
+// dropped and, unless Flags.CollectAll is set, false is returned.
+func (self *scanner) step() bool {
+	self.trim_space()
+	start := len(self.tokens)
+	ok := false
+	switch {
+	case len(self.params.content) == 0:
+		// only spaces were left before the end of input
+		ok = true
+	case self.expect('\n'):
+		ok = self.scan_newline()
+	case self.expect_comment():
+		ok = self.scan_comment()
+	case self.params.flags.AnonymousSections && (self.expect(kTableBegin) || self.expect(kListBegin)):
+		ok = self.scan_anonymous_value()
+	case self.allow_includes && self.expect_include():
+		ok = self.scan_include()
+	case self.params.flags.AllowTrailingContent && self.trailing():
+		self.advance(len(self.params.content))
+		ok = true
+	case self.expect(kKeyValEnd) || self.expect(kTableEnd) || self.expect(kListEnd):
+		self.errorf("stray delimiter '%c'", self.params.content[0])
+	case self.trailing():
+		self.errorf("unexpected content after the last key-value pair")
+	default:
+		ok = self.scan_key_value()
+	}
+	if ok && self.check_tokens() {
+		return true
+	}
+	self.tokens = self.tokens[:start]
+	if !self.params.flags.CollectAll {
+		return false
+	}
+	self.errs = append(self.errs, self.err)
+	if self.fatal {
+		self.finish()
+		return false
+	}
+	self.recover()
+	return true
+}
+
+// trailing reports whether the rest of the input can't hold a key-value, as
+// it has no key value separator.
+func (self *scanner) trailing() bool {
+	return strings.IndexByte(self.params.content, kKeyValSep) == -1
+}
+
+// finish joins the errors collected in CollectAll mode, returning false if
+// there are any.
+func (self *scanner) finish() bool {
+	if len(self.errs) != 0 {
+		self.err = errors.Join(self.errs...)
+		return false
+	}
+	return true
+}
+
+// recover skips past the next semicolon or up to the next newline, to resume
+// scanning after an error.
+func (self *scanner) recover() {
+	self.space = ""
+	c, i := indexAny(self.params.content, ";\n")
+	switch {
+	case i == -1:
+		self.advance(len(self.params.content))
+	case c == kKeyValEnd:
+		self.advance(i + 1)
+	default:
+		self.advance(i)
+	}
+}
+
+func (self *scanner) scan_anonymous_value() bool {
+	key := "_" + strconv.Itoa(self.anonymous)
+	self.anonymous++
+
+	self.push(Token{Kind: TokenKindKey, Value: key, Line: self.line, Column: self.column})
+	self.push(Token{Kind: TokenKindDelim, Value: string(kKeyValSep), Line: self.line, Column: self.column})
+
+	ok := false
+	if self.expect(kTableBegin) {
+		ok = self.scan_table_value()
+	} else {
+		ok = self.scan_list_value()
+	}
+	if !ok {
+		return false
+	}
 
-	return s.tokens, nil
+	self.trim_space()
+	if !self.scan_delim(kKeyValEnd) {
+		self.push(Token{Kind: TokenKindDelim, Value: string(kKeyValEnd), Line: self.line, Column: self.column})
+	}
+	return true
 }
 
 func (self *scanner) trim_space() {
-	self.params.content = strings.TrimLeft(self.params.content, spaces)
+	rest := strings.TrimLeft(self.params.content, spaces)
+	if self.params.flags.KeepSpace {
+		self.space += self.params.content[:len(self.params.content)-len(rest)]
+	}
+	self.advance(len(self.params.content) - len(rest))
+}
+
+func (self *scanner) expect_comment() bool {
+	return strings.HasPrefix(self.params.content, self.params.flags.comment_prefix())
 }
 
 func (self *scanner) expect(c byte) bool {
@@ -169,20 +904,32 @@ func (self *scanner) expect(c byte) bool {
 }
 
 func (self *scanner) scan_newline() bool {
+	self.space = ""
 	self.line++
 	self.advance(1)
 	return true
 }
 
 func (self *scanner) advance(n int) {
+	skipped := self.params.content[:n]
+	if i := strings.LastIndexByte(skipped, '\n'); i != -1 {
+		self.column = n - i
+	} else {
+		self.column += n
+	}
 	self.params.content = self.params.content[n:]
 }
 
 func (self *scanner) scan_comment() bool {
 	newline := strings.IndexByte(self.params.content, '\n')
 	if newline == -1 {
-		self.errorf("comment does not end with newline")
-		return false
+		// the comment ends the input
+		newline = len(self.params.content)
+	}
+	self.comments++
+	if self.params.flags.KeepComments {
+		self.append(TokenKindComment, newline)
+		return true
 	}
 	self.advance(newline)
 	return true
@@ -198,7 +945,13 @@ func (self *scanner) scan_key_value() bool {
 }
 
 func (self *scanner) errorf(format string, args ...any) {
-	self.err = fmt.Errorf("%s:%d: error: scan: %s", self.params.file, self.line, fmt.Sprintf(format, args...))
+	self.err = &Error{
+		File:    self.params.file,
+		Line:    self.line,
+		Column:  self.column,
+		Stage:   "scan",
+		Message: fmt.Sprintf(format, args...),
+	}
 
 	if self.params.flags.AbortOnError {
 		panic(self.err)
@@ -220,11 +973,21 @@ func (self *scanner) scan_key() bool {
 		self.errorf("key-value pair is missing separator")
 		return false
 	}
-	self.append(TokenKindKey, i)
-	if len(self.tokens[len(self.tokens)-1].Value) == 0 {
+	key := strings.TrimRight(self.params.content[:i], spaces)
+	if key == "" {
 		self.errorf("empty key")
 		return false
 	}
+	// with a custom IdentifierFunc, keys are validated by the parser
+	if self.params.flags.IdentifierFunc == nil {
+		if j := invalid_key_char(key); j != -1 {
+			c, _ := utf8.DecodeRuneInString(key[j:])
+			self.advance(j)
+			self.errorf("invalid character '%c' in key '%s'", c, key)
+			return false
+		}
+	}
+	self.append(TokenKindKey, i)
 	return true
 }
 
@@ -240,12 +1003,16 @@ func (self *scanner) scan_value() bool {
 		ok = self.scan_string_value()
 	case self.expect(kRawStringBegin):
 		ok = self.scan_raw_string()
+	case strings.HasPrefix(self.params.content, kHeredocBegin):
+		ok = self.scan_heredoc()
 	default:
 		ok = self.scan_int_or_bool_value()
 	}
 	if !ok {
 		return false
 	}
+	// like after integers, e.g. "a" ; as written by Format
+	self.trim_space()
 	if !self.scan_delim(kKeyValEnd) {
 		self.errorf("value does not end with semicolon")
 		return false
@@ -262,26 +1029,28 @@ func (self *scanner) scan_delim(c byte) bool {
 }
 
 func (self *scanner) scan_string_value() bool {
-	// advance past leading quote
-	end := 1
 	s := self.params.content
 
-	for {
-		// search for trailing quote
-		i := strings.IndexByte(s[end:], kStringBegin)
-		if i == -1 {
-			self.errorf("string value does not end with quote")
-			return false
-		}
-
-		// advance
-		end += i + 1
-
-		// stop if quote is not escaped
-		if prev := s[end-2]; prev != '\\' {
+	// search for the trailing quote in one pass, past the leading quote,
+	// skipping each backslash together with the character it escapes
+	end := -1
+	for i := 1; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+		} else if s[i] == kStringBegin {
+			end = i + 1
 			break
 		}
 	}
+	if end == -1 {
+		self.errorf("string value does not end with quote")
+		return false
+	}
+
+	// -2 for leading and trailing quotes
+	if !self.check_string_length(end - 2) {
+		return false
+	}
 
 	self.append(TokenKindValue, end)
 
@@ -295,6 +1064,15 @@ func (self *scanner) scan_raw_string() bool {
 		return false
 	}
 
+	if !self.check_string_length(end) {
+		return false
+	}
+
+	// +1 for leading quote
+	if !self.check_raw_string(self.params.content[1 : end+1]) {
+		return false
+	}
+
 	// +2 for leading and trailing quotes
 	self.append(TokenKindValue, end+2)
 
@@ -304,21 +1082,173 @@ func (self *scanner) scan_raw_string() bool {
 	return true
 }
 
-func (self *scanner) scan_int_or_bool_value() bool {
-	// search for all possible value endings
-	// if semicolon(or none of them) is not found => error
-	c, end := indexAny(self.params.content, ";]}\n")
-	if end == -1 || c != kKeyValEnd {
-		self.errorf("integer or boolean value does not end with semicolon")
+// scan_heredoc scans a string given as the lines between <<MARKER and a
+// line holding only MARKER and the terminating semicolon, e.g.
+//
+//	text = <<END
+//	a `quoted` "text"
+//	END;
+//
+// The marker line may be indented. The token holds the markers and the
+// lines, see heredoc_body.
+func (self *scanner) scan_heredoc() bool {
+	s := self.params.content
+	first := strings.IndexByte(s, '\n')
+	if first == -1 {
+		self.errorf("heredoc marker is not followed by newline")
 		return false
 	}
-	self.append(TokenKindValue, end)
-	return true
-}
+	marker := strings.TrimRight(s[len(kHeredocBegin):first], spaces+"\r")
+	if marker == "" || !is_identifier(marker) {
+		self.errorf("heredoc marker must be an identifier: '%s'", marker)
+		return false
+	}
+
+	// find the line with the closing marker
+	for start := first + 1; start < len(s); {
+		line := s[start:]
+		if nl := strings.IndexByte(line, '\n'); nl != -1 {
+			line = line[:nl]
+		}
+		trimmed := strings.TrimLeft(line, spaces)
+		if rest, ok := strings.CutPrefix(trimmed, marker); ok && strings.HasPrefix(strings.TrimLeft(rest, spaces), string(kKeyValEnd)) {
+			end := start + len(line) - len(rest)
+			if !self.check_string_length(len(heredoc_body(s[:end]))) {
+				return false
+			}
+			// from the second '<', like from the opening quote of a raw
+			// string, so that errors have the right position
+			if !self.check_raw_string(s[1:end]) {
+				return false
+			}
+			self.append(TokenKindValue, end)
+			self.line += strings.Count(self.tokens[len(self.tokens)-1].Value, "\n")
+			// spaces between the marker and the semicolon
+			self.trim_space()
+			return true
+		}
+		start += len(line) + 1
+	}
+
+	self.errorf("heredoc does not end with '%s;'", marker)
+	return false
+}
+
+// dedent removes the longest whitespace prefix common to the lines of s, with
+// tabs and spaces compared as is. Lines with only whitespace do not count and
+// are emptied, so the indentation of a closing backtick on its own line is
+// removed and the string ends with a newline. A newline right after the
+// opening backtick is removed; if there is none, the text on the line of the
+// opening backtick does not count and keeps its indentation.
+func dedent(s string) string {
+	s, full := strings.CutPrefix(s, "\n")
+	lines := strings.Split(s, "\n")
+
+	var prefix *string
+	for i, line := range lines {
+		text := strings.TrimLeft(line, spaces)
+		if text == "" || (i == 0 && !full) {
+			continue
+		}
+		indent := line[:len(line)-len(text)]
+		if prefix == nil {
+			prefix = &indent
+			continue
+		}
+		for !strings.HasPrefix(indent, *prefix) {
+			*prefix = (*prefix)[:len(*prefix)-1]
+		}
+	}
+
+	for i, line := range lines {
+		switch {
+		case strings.TrimLeft(line, spaces) == "":
+			lines[i] = ""
+		case i == 0 && !full:
+		case prefix != nil:
+			lines[i] = line[len(*prefix):]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// heredoc_body returns the string given by a heredoc token: the lines between
+// the markers, each with its newline.
+func heredoc_body(tok string) string {
+	first := strings.IndexByte(tok, '\n')
+	last := strings.LastIndexByte(tok, '\n')
+	return tok[first+1 : last+1]
+}
+
+// check_raw_string rejects control characters other than newline and tab
+// when Flags.StrictRawStrings is set.
+func (self *scanner) check_raw_string(s string) bool {
+	if !self.params.flags.StrictRawStrings {
+		return true
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\n' || c == '\t' || (c >= 0x20 && c != 0x7f) {
+			continue
+		}
+		// report the position of the offending character
+		self.line += strings.Count(s[:i], "\n")
+		if nl := strings.LastIndexByte(s[:i], '\n'); nl != -1 {
+			self.column = i - nl
+		} else {
+			// +1 for leading quote
+			self.column += i + 1
+		}
+		self.errorf("raw string contains control character 0x%02x at offset %d", c, i)
+		return false
+	}
+	return true
+}
+
+func (self *scanner) check_string_length(n int) bool {
+	limit := self.params.flags.MaxStringLength
+	if limit > 0 && n > limit {
+		self.errorf("string value exceeds maximum length of %d bytes", limit)
+		return false
+	}
+	return true
+}
+
+func (self *scanner) scan_int_or_bool_value() bool {
+	// search for all possible value endings
+	// if semicolon(or none of them) is not found => error
+	c, end := indexAny(self.params.content, ";]}\n")
+	if end == -1 || c != kKeyValEnd {
+		self.errorf("integer or boolean value does not end with semicolon")
+		return false
+	}
+	self.append(TokenKindValue, end)
+	return true
+}
+
+// enter moves one level deeper into nested values, failing if that exceeds
+// Flags.MaxDepth. Each successful call must be paired with one to leave.
+func (self *scanner) enter() bool {
+	if max := self.params.flags.max_depth(); max >= 0 && self.depth >= max {
+		self.errorf("maximum nesting depth exceeded")
+		return false
+	}
+	self.depth++
+	return true
+}
+
+func (self *scanner) leave() { self.depth-- }
 
 func (self *scanner) scan_list_value() bool {
+	if !self.enter() {
+		return false
+	}
+	defer self.leave()
 	self.append_delim()
 	for {
+		if !self.check_tokens() {
+			return false
+		}
 		self.trim_space()
 		if len(self.params.content) == 0 {
 			self.errorf("end of input without list end")
@@ -330,7 +1260,7 @@ func (self *scanner) scan_list_value() bool {
 			}
 			continue
 		}
-		if self.expect(kCommentBegin) {
+		if self.expect_comment() {
 			if !self.scan_comment() {
 				return false
 			}
@@ -351,8 +1281,15 @@ func (self *scanner) scan_list_value() bool {
 }
 
 func (self *scanner) scan_table_value() bool {
+	if !self.enter() {
+		return false
+	}
+	defer self.leave()
 	self.append_delim()
 	for {
+		if !self.check_tokens() {
+			return false
+		}
 		self.trim_space()
 		if len(self.params.content) == 0 {
 			self.errorf("end of input without table end")
@@ -364,7 +1301,7 @@ func (self *scanner) scan_table_value() bool {
 			}
 			continue
 		}
-		if self.expect(kCommentBegin) {
+		if self.expect_comment() {
 			if !self.scan_comment() {
 				return false
 			}
@@ -384,25 +1321,41 @@ func (self *scanner) scan_table_value() bool {
 	}
 }
 
+func (self *scanner) push(tok Token) {
+	self.tokens = append(self.tokens, tok)
+	self.count++
+}
+
 func (self *scanner) append_delim() {
-	self.tokens = append(self.tokens, Token{
-		Kind:  TokenKindDelim,
-		Value: self.params.content[0:1],
-		Line:  self.line,
+	self.push(Token{
+		Kind:   TokenKindDelim,
+		Value:  self.params.content[0:1],
+		Line:   self.line,
+		Column: self.column,
+		Space:  self.space,
 	})
+	self.space = ""
 	self.advance(1)
 }
 
 func (self *scanner) append(kind TokenKind, end int) {
-	val := self.params.content[:end]
-	val = strings.TrimRight(val, spaces)
-
-	self.tokens = append(self.tokens, Token{
-		Kind:  kind,
-		Value: val,
-		Line:  self.line,
+	raw := self.params.content[:end]
+	val := strings.TrimRight(raw, spaces)
+
+	self.push(Token{
+		Kind:   kind,
+		Value:  val,
+		Line:   self.line,
+		Column: self.column,
+		Space:  self.space,
 	})
 
+	// trailing spaces belong to the next token
+	self.space = ""
+	if self.params.flags.KeepSpace {
+		self.space = raw[len(val):]
+	}
+
 	self.advance(end)
 }
 
@@ -412,10 +1365,169 @@ type parser struct {
 	table  Table
 	i      int
 	err    error
+	depth  int
+
+	// defining holds the path of the key-value being parsed, with the
+	// indexes of list elements, building the tables being parsed, and
+	// copied the number of values copied, for references
+	defining []string
+	building []building
+	copied   int
+
+	// synthetic holds the keys given to anonymous sections, and anonymous
+	// their number
+	synthetic map[string]bool
+	anonymous int
+
+	// includes are the include directives of the input, in order, which
+	// are given to splice once the parser gets to them
+	includes []include
+	splice   func(inc include) error
 }
 
 func ParseTokens(file, content string, flags Flags, tokens []Token) (Table, error) {
-	p := parser{
+	if err := flags.check(); err != nil {
+		return nil, err
+	}
+
+	p := new_parser(file, content, flags, tokens)
+	return p.parse()
+}
+
+// parse parses the top-level key-values of the input.
+func (self *parser) parse() (Table, error) {
+	flags := self.params.flags
+
+	var errs []error
+
+	for self.i < len(self.tokens) {
+		comments := self.parse_comments()
+		if err := self.splice_includes(); err != nil {
+			return nil, err
+		}
+		if self.i == len(self.tokens) {
+			if n := len(self.table); n != 0 {
+				self.table[n-1].Trailing = comments
+			}
+			break
+		}
+		if flags.AllowTrailingContent && self.trailing() {
+			break
+		}
+		if tok := self.get(); tok.Kind == TokenKindDelim {
+			self.errorf("stray delimiter '%s'", tok.Value)
+			if !flags.CollectAll {
+				return nil, self.err
+			}
+			errs = append(errs, self.err)
+			self.pop()
+			continue
+		}
+		start := self.i
+		kv, ok := self.parse_key_value(self.table)
+		if !ok {
+			if !flags.CollectAll {
+				return nil, self.err
+			}
+			errs = append(errs, self.err)
+			self.i = start
+			self.skip_key_value()
+			continue
+		}
+		kv.Comments = comments
+		kv.Comment = self.parse_line_comment()
+		self.table = self.put(self.table, *kv)
+	}
+	// the directives after the last key-value
+	self.i = len(self.tokens)
+	if err := self.splice_includes(); err != nil {
+		return nil, err
+	}
+
+	if len(errs) != 0 {
+		return self.table, errors.Join(errs...)
+	}
+	return self.table, nil
+}
+
+// skip_key_value moves past the next key-value without building it, to
+// resume parsing after an error.
+func (self *parser) skip_key_value() {
+	if self.i < len(self.tokens) && self.get().Kind == TokenKindKey {
+		self.pop()
+	}
+	if self.i < len(self.tokens) && self.expect_delim(kKeyValSep) {
+		self.pop()
+	}
+	self.skip_value()
+}
+
+// put replaces the key-value with the same key, or appends kv if there is
+// none.
+func (self Table) put(kv KeyValue) Table {
+	return self.put_fold(kv, false)
+}
+
+// put_fold is like put, but keys differing only in ASCII case are the same
+// if fold is set.
+func (self Table) put_fold(kv KeyValue, fold bool) Table {
+	if i := self.index_of(kv.Key, fold); i != -1 {
+		self[i] = kv
+		return self
+	}
+	return append(self, kv)
+}
+
+// index_of returns the index of key, or -1 if not found. Keys differing only
+// in ASCII case match if fold is set.
+func (self Table) index_of(key string, fold bool) int {
+	for i := range self {
+		if self[i].Key == key || fold && equal_fold_ascii(self[i].Key, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+func equal_fold_ascii(a, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		if a[i] != b[i] && (!is_letter(a[i]) || lower(a[i]) != lower(b[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+// parse_comments moves past the comment tokens at the current position and
+// returns their values.
+func (self *parser) parse_comments() []string {
+	var out []string
+	for self.i < len(self.tokens) && self.get().Kind == TokenKindComment {
+		out = append(out, self.get().Value)
+		self.pop()
+	}
+	return out
+}
+
+// parse_line_comment returns the comment on the line of the token before,
+// e.g. after the semicolon of a = 1; # about a, or nothing.
+func (self *parser) parse_line_comment() string {
+	if self.i == 0 || self.i == len(self.tokens) {
+		return ""
+	}
+	tok := self.get()
+	if tok.Kind != TokenKindComment || tok.Line != self.tokens[self.i-1].Line {
+		return ""
+	}
+	self.pop()
+	return tok.Value
+}
+
+func new_parser(file, content string, flags Flags, tokens []Token) *parser {
+	return &parser{
 		params: params{
 			file:    file,
 			content: content,
@@ -423,16 +1535,280 @@ func ParseTokens(file, content string, flags Flags, tokens []Token) (Table, erro
 		},
 		tokens: tokens,
 	}
+}
+
+// ParseSection parses only the value of the given key, which can be a dotted
+// path to a nested one. Only the top-level key-values under the first
+// segment of key are built, e.g. server = { port = 1; }; and
+// server.host = "h"; for server.port. The rest of the input is scanned, so
+// it must still be well-formed, but it is not built into a tree.
+func ParseSection(file, content string, key string, flags Flags) (Value, error) {
+	tokens, err := Scan(file, content, flags)
+	if err != nil {
+		return Value{}, err
+	}
 
+	p := new_parser(file, content, flags, tokens)
+	fold := flags.CaseInsensitiveKeys
+	head, _, _ := strings.Cut(key, ".")
 	for p.i < len(tokens) {
+		p.parse_comments()
+		if p.i == len(tokens) {
+			break
+		}
+		if !p.expect(TokenKindKey) {
+			p.errorf("expected key token, %s", p.found())
+			return Value{}, p.err
+		}
+		name, _, _ := strings.Cut(p.get().Value, ".")
+		if name != head && !(fold && equal_fold_ascii(name, head)) {
+			if p.is_anonymous() {
+				// keep the numbering of the scanner
+				p.anonymous++
+			}
+			p.skip_key_value()
+			continue
+		}
 		kv, ok := p.parse_key_value(p.table)
 		if !ok {
-			return nil, p.err
+			return Value{}, p.err
+		}
+		p.table = p.put(p.table, *kv)
+	}
+
+	t := p.table
+	segments := strings.Split(key, ".")
+	for i, seg := range segments {
+		j := t.index_of(seg, fold)
+		if j == -1 {
+			break
+		}
+		if i == len(segments)-1 {
+			return t[j].Value, nil
+		}
+		if t[j].Value.Kind != ValueKindTable {
+			break
+		}
+		t = t[j].Value.Data.Table
+	}
+	return Value{}, &Error{
+		File:    file,
+		Stage:   "parse",
+		Message: fmt.Sprintf("key '%s' not found", key),
+	}
+}
+
+// CountElements returns the number of elements of the list under the given
+// key, without parsing them. As for ParseSection, the key can be a dotted
+// path, through the tables written as a.b = { c = [ 1; ]; }; or with dotted
+// keys, like a.b.c = [ 1; ];.
+func CountElements(file, content string, key string, flags Flags) (int, error) {
+	tokens, err := Scan(file, content, flags)
+	if err != nil {
+		return 0, err
+	}
+
+	p := new_parser(file, content, flags, tokens)
+	if !p.find_section(key) {
+		return 0, p.err
+	}
+
+	if !p.parse_delim(kListBegin) {
+		p.errorf("value of key '%s' is not list", key)
+		return 0, p.err
+	}
+
+	n := 0
+	depth := 1
+	for ; depth > 0 && p.i < len(tokens); p.pop() {
+		tok := p.get()
+		if tok.Kind != TokenKindDelim {
+			continue
+		}
+		switch tok.Value[0] {
+		case kListBegin, kTableBegin:
+			depth++
+		case kListEnd, kTableEnd:
+			depth--
+		case kKeyValEnd:
+			if depth == 1 {
+				n++
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// trailing reports whether no key token is left.
+func (self parser) trailing() bool {
+	for _, tok := range self.tokens[self.i:] {
+		if tok.Kind == TokenKindKey {
+			return false
+		}
+	}
+	return true
+}
+
+// find_section moves past the separator of key, which can be a dotted path,
+// or fails if it is not found. With duplicate keys, the last definition is
+// found, as it is the one kept by the parser.
+func (self *parser) find_section(key string) bool {
+	i, ok := self.find_in(key, false)
+	if !ok {
+		return false
+	}
+	if i == -1 {
+		self.err = &Error{
+			File:    self.params.file,
+			Stage:   "parse",
+			Message: fmt.Sprintf("key '%s' not found", key),
+		}
+		return false
+	}
+	self.i = i
+	return true
+}
+
+// find_in returns the position after the separator of key in the current
+// table, or -1 if not found, leaving the parser at the end of the table,
+// before its '}' if nested. The tables whose key is a prefix of key are
+// searched too.
+func (self *parser) find_in(key string, nested bool) (int, bool) {
+	fold := self.params.flags.CaseInsensitiveKeys
+	found := -1
+	for self.i < len(self.tokens) {
+		self.parse_comments()
+		if self.i == len(self.tokens) || nested && self.expect_delim(kTableEnd) {
+			break
+		}
+		if !self.expect(TokenKindKey) {
+			self.errorf("expected key token, %s", self.found())
+			return -1, false
+		}
+		name := self.get().Value
+		self.pop()
+
+		if !self.parse_delim(kKeyValSep) {
+			self.errorf("missing key value separator, %s", self.found())
+			return -1, false
+		}
+
+		start := self.i
+		prefix := len(name) < len(key) && key[len(name)] == '.'
+		if prefix {
+			prefix = key[:len(name)] == name || fold && equal_fold_ascii(key[:len(name)], name)
+		}
+		switch {
+		case name == key || fold && equal_fold_ascii(name, key):
+			found = start
+		case prefix && self.expect_delim(kTableBegin):
+			self.pop()
+			i, ok := self.find_in(key[len(name)+1:], true)
+			if !ok {
+				return -1, false
+			}
+			if i != -1 {
+				found = i
+			}
+			self.i = start
+		}
+		self.skip_value()
+	}
+	return found, true
+}
+
+// skip_value moves past the next value and its terminating delimiter
+// without building it.
+func (self *parser) skip_value() {
+	depth := 0
+	for self.i < len(self.tokens) {
+		tok := self.get()
+		self.pop()
+		if tok.Kind != TokenKindDelim {
+			continue
+		}
+		switch tok.Value[0] {
+		case kListBegin, kTableBegin:
+			depth++
+		case kListEnd, kTableEnd:
+			depth--
+		case kKeyValEnd:
+			if depth == 0 {
+				return
+			}
+		}
+	}
+}
+
+// building is a table being parsed, at the given path.
+type building struct {
+	path  []string
+	table *Table
+}
+
+// resolve returns a copy of the value a reference refers to. It is looked up
+// in the tables being parsed which hold it, innermost first, then in the
+// top-level table.
+func (self *parser) resolve(path string) (Value, bool) {
+	if path == "" {
+		self.errorf("empty reference")
+		return Value{}, false
+	}
+	parts := strings.Split(path, ".")
+	cycle := len(parts) <= len(self.defining) && slices.Equal(parts, self.defining[:len(parts)])
+	if cycle && !self.params.flags.AllowDuplicateKeys {
+		self.errorf("reference '@%s' is a cycle, it refers to a value being defined", path)
+		return Value{}, false
+	}
+
+	v, err := self.lookup(parts)
+	if err != nil {
+		if cycle {
+			// not a key defined again
+			self.errorf("reference '@%s' is a cycle, it refers to a value being defined", path)
+		} else {
+			self.errorf("reference '@%s' is not defined before: %s", path, err)
+		}
+		return Value{}, false
+	}
+
+	self.copied += v.count(maxReferenceValues - self.copied + 1)
+	if self.copied > maxReferenceValues {
+		self.errorf("reference '@%s' copies too many values, the limit is %d", path, maxReferenceValues)
+		return Value{}, false
+	}
+	return v.clone(), true
+}
+
+func (self *parser) lookup(parts []string) (Value, error) {
+	for i := len(self.building) - 1; i >= 0; i-- {
+		b := self.building[i]
+		if len(b.path) >= len(parts) || !slices.Equal(b.path, parts[:len(b.path)]) {
+			continue
+		}
+		if v, err := b.table.GetPath(strings.Join(parts[len(b.path):], ".")); err == nil {
+			return v, nil
 		}
-		p.table = append(p.table, *kv)
 	}
+	return self.table.GetPath(strings.Join(parts, "."))
+}
 
-	return p.table, nil
+// put adds kv to t, creating or extending the nested tables named by a dotted
+// key. The conflicts were checked by parse_key.
+func (self *parser) put(t Table, kv KeyValue) Table {
+	fold := self.params.flags.CaseInsensitiveKeys
+	key, rest, dotted := strings.Cut(kv.Key, ".")
+	if !dotted {
+		return t.put_fold(kv, fold)
+	}
+	parent := KeyValue{Key: key, Value: Value{Kind: ValueKindTable}, Line: kv.Line, Column: kv.Column}
+	if i := t.index_of(key, fold); i != -1 {
+		parent = t[i]
+	}
+	kv.Key = rest
+	parent.Value.Data.Table = self.put(parent.Value.Data.Table, kv)
+	return t.put_fold(parent, fold)
 }
 
 func (self *parser) parse_key_value(parent Table) (*KeyValue, bool) {
@@ -440,20 +1816,26 @@ func (self *parser) parse_key_value(parent Table) (*KeyValue, bool) {
 	if !ok {
 		return nil, false
 	}
+	tok := self.tokens[self.i-1]
 
 	if !self.parse_delim(kKeyValSep) {
-		self.errorf("missing key value separator")
+		self.errorf("missing key value separator, %s", self.found())
 		return nil, false
 	}
 
+	n := len(self.defining)
+	self.defining = append(self.defining, strings.Split(key, ".")...)
 	val, ok := self.parse_value()
+	self.defining = self.defining[:n]
 	if !ok {
 		return nil, false
 	}
 
 	out := &KeyValue{
-		Key:   key,
-		Value: *val,
+		Key:    key,
+		Value:  *val,
+		Line:   tok.Line,
+		Column: tok.Column,
 	}
 
 	return out, true
@@ -461,30 +1843,89 @@ func (self *parser) parse_key_value(parent Table) (*KeyValue, bool) {
 
 func (self *parser) parse_key(parent Table) (string, bool) {
 	if !self.expect(TokenKindKey) {
-		self.errorf("expected key token")
+		self.errorf("expected key token, %s", self.found())
 		return "", false
 	}
 
 	tok := self.get()
+	name := tok.Value
+	anonymous := self.is_anonymous()
+	if anonymous {
+		// numbered again, to go on from the files included before
+		name = "_" + strconv.Itoa(self.anonymous)
+		self.anonymous++
+	}
 
-	if !is_identifier(tok.Value) {
-		self.errorf("key is not a valid identifier: '%s'", tok.Value)
-		return "", false
+	valid := is_identifier
+	if self.params.flags.IdentifierFunc != nil {
+		valid = self.params.flags.IdentifierFunc
 	}
 
-	// check if key is unique
-	for _, kv := range parent {
-		if kv.Key == tok.Value {
-			self.errorf("key '%s' is not unique for current table", tok.Value)
+	// a dotted key defines a key of a nested table
+	segments := strings.Split(name, ".")
+	for _, seg := range segments {
+		if !valid(seg) {
+			self.errorf("key is not a valid identifier: '%s'", name)
+			return "", false
+		}
+	}
+
+	// synthetic keys are checked even with AllowDuplicateKeys, as they
+	// must not replace real keys, nor be replaced
+	if self.depth == 0 && (anonymous || self.synthetic[segments[0]]) {
+		if i := self.table.index_of(segments[0], false); i != -1 {
+			self.errorf("key '%s' clashes with the synthetic key of an anonymous section", self.table[i].Key)
+			return "", false
+		}
+	}
+
+	fold := self.params.flags.CaseInsensitiveKeys
+	for i, seg := range segments[:len(segments)-1] {
+		j := parent.index_of(seg, fold)
+		if j == -1 {
+			// the rest of the tables will be created
+			parent = nil
+			break
+		}
+		if parent[j].Value.Kind != ValueKindTable {
+			self.errorf("key '%s' conflicts with '%s', which is not a table", name, strings.Join(segments[:i+1], "."))
 			return "", false
 		}
+		parent = parent[j].Value.Data.Table
 	}
+	last := segments[len(segments)-1]
 
-	key := tok.Value
+	// check if key is unique
+	if i := parent.index_of(last, fold); i != -1 && !self.params.flags.AllowDuplicateKeys {
+		if parent[i].Key != last {
+			self.errorf("key '%s' is not unique for current table, it differs only in case from '%s'", name, parent[i].Key)
+		} else {
+			self.errorf("key '%s' is not unique for current table", name)
+		}
+		return "", false
+	}
+
+	if anonymous {
+		if self.synthetic == nil {
+			self.synthetic = make(map[string]bool)
+		}
+		self.synthetic[name] = true
+	}
 
 	self.pop()
 
-	return key, true
+	return name, true
+}
+
+// is_anonymous reports whether the current key was added by the scanner for
+// an anonymous section. Unlike a real key, it has the position of the
+// separator that follows it.
+func (self *parser) is_anonymous() bool {
+	if !self.params.flags.AnonymousSections || self.i+1 >= len(self.tokens) {
+		return false
+	}
+	key, sep := self.tokens[self.i], self.tokens[self.i+1]
+	return key.Kind == TokenKindKey && sep.Kind == TokenKindDelim && key.Line == sep.Line && key.Column == sep.Column
 }
 
 func (self *parser) parse_value() (*Value, bool) {
@@ -504,29 +1945,57 @@ func (self *parser) parse_value() (*Value, bool) {
 	}
 
 	if !self.parse_delim(kKeyValEnd) {
-		self.errorf("missing key value end")
+		self.errorf("missing key value end, %s", self.found())
 		return nil, false
 	}
 
 	return out, true
 }
 
-func (self *parser) parse_list_value() (*Value, bool) {
-	out := &Value{
-		Kind: ValueKindList,
+// enter moves one level deeper into nested values, failing if that exceeds
+// Flags.MaxDepth. Each successful call must be paired with one to leave.
+func (self *parser) enter() bool {
+	if max := self.params.flags.max_depth(); max >= 0 && self.depth >= max {
+		self.errorf("maximum nesting depth exceeded")
+		return false
+	}
+	self.depth++
+	return true
+}
+
+func (self *parser) leave() { self.depth-- }
+
+func (self *parser) parse_list_value() (*Value, bool) {
+	if !self.enter() {
+		return nil, false
+	}
+	defer self.leave()
+
+	out := &Value{
+		Kind: ValueKindList,
 	}
 
 	self.pop()
 
+	n := len(self.defining)
+	defer func() { self.defining = self.defining[:n] }()
+
 	for {
+		comments := self.parse_comments()
 		if self.parse_delim(kListEnd) {
+			if n := len(out.Data.List); n != 0 {
+				out.Data.List[n-1].Trailing = comments
+			}
 			return out, true
 		}
 
+		self.defining = append(self.defining[:n], strconv.Itoa(len(out.Data.List)))
 		v, ok := self.parse_value()
 		if !ok {
 			return nil, false
 		}
+		v.Comments = comments
+		v.Comment = self.parse_line_comment()
 		out.Data.List = append(out.Data.List, *v)
 
 		if self.parse_delim(kListEnd) {
@@ -536,14 +2005,28 @@ func (self *parser) parse_list_value() (*Value, bool) {
 }
 
 func (self *parser) parse_table_value() (*Value, bool) {
+	if !self.enter() {
+		return nil, false
+	}
+	defer self.leave()
+
 	out := &Value{
 		Kind: ValueKindTable,
 	}
 
 	self.pop()
 
+	if self.params.flags.AllowReferences {
+		self.building = append(self.building, building{slices.Clone(self.defining), &out.Data.Table})
+		defer func() { self.building = self.building[:len(self.building)-1] }()
+	}
+
 	for {
+		comments := self.parse_comments()
 		if self.parse_delim(kTableEnd) {
+			if n := len(out.Data.Table); n != 0 {
+				out.Data.Table[n-1].Trailing = comments
+			}
 			return out, true
 		}
 
@@ -551,7 +2034,9 @@ func (self *parser) parse_table_value() (*Value, bool) {
 		if !ok {
 			return nil, false
 		}
-		out.Data.Table = append(out.Data.Table, *kv)
+		kv.Comments = comments
+		kv.Comment = self.parse_line_comment()
+		out.Data.Table = self.put(out.Data.Table, *kv)
 
 		if self.parse_delim(kTableEnd) {
 			return out, true
@@ -561,7 +2046,7 @@ func (self *parser) parse_table_value() (*Value, bool) {
 
 func (self *parser) parse_simple_value() (*Value, bool) {
 	if !self.expect(TokenKindValue) {
-		self.errorf("expected value token")
+		self.errorf("expected value token, %s", self.found())
 		return nil, false
 	}
 
@@ -571,18 +2056,40 @@ func (self *parser) parse_simple_value() (*Value, bool) {
 	out := &Value{}
 
 	switch {
+	case val == "":
+		self.errorf("missing value")
+		return nil, false
+
 	case val[0] == kStringBegin:
 		data, err := normString(val[1 : len(val)-1])
 		if err != nil {
 			self.errorf("could not normalize string: %s", err)
 			return nil, false
 		}
+		if self.params.flags.ExpandEnv {
+			data, err = expand_env(data)
+			if err != nil {
+				self.errorf("could not expand string: %s", err)
+				return nil, false
+			}
+		}
 		out.Kind = ValueKindString
 		out.Data.String = data
 
 	case val[0] == kRawStringBegin:
 		out.Kind = ValueKindString
 		out.Data.String = val[1 : len(val)-1]
+		if self.params.flags.DedentRawStrings {
+			out.Data.String = dedent(out.Data.String)
+		}
+
+	case strings.HasPrefix(val, kHeredocBegin):
+		out.Kind = ValueKindString
+		out.Data.String = heredoc_body(val)
+		if self.params.flags.DedentRawStrings {
+			// the body starts on a line of its own
+			out.Data.String = dedent("\n" + out.Data.String)
+		}
 
 	case val == "true":
 		out.Kind = ValueKindBoolean
@@ -592,15 +2099,42 @@ func (self *parser) parse_simple_value() (*Value, bool) {
 		out.Kind = ValueKindBoolean
 		out.Data.Boolean = false
 
+	case val == "null":
+		out.Kind = ValueKindNull
+
+	case self.params.flags.AllowReferences && strings.HasPrefix(val, "@"):
+		var v Value
+		v, ok = self.resolve(val[1:])
+		out = &v
+
+	case is_float(val):
+		f, err := str_to_float(val)
+		if err != nil {
+			self.errorf("value '%s' is not a float: %s", val, err)
+			ok = false
+			break
+		}
+		out.Kind = ValueKindFloat
+		out.Data.Float = f
+
 	default:
 		i, err := str_to_int(val, 0)
 		if err != nil {
-			self.errorf("value '%s' is not an integer: %s", val, err)
-			ok = false
-		} else {
+			// too big for int64, but it may fit in uint64
+			u, uerr := str_to_uint(strings.TrimPrefix(val, "+"), 0)
+			if uerr != nil || u <= math.MaxInt64 {
+				self.errorf("value '%s' is not an integer: %s", val, err)
+				ok = false
+				break
+			}
 			out.Kind = ValueKindInteger
-			out.Data.Integer = i
+			out.Data.Uint = u
+			out.Data.Base = integer_base(val)
+			break
 		}
+		out.Kind = ValueKindInteger
+		out.Data.Integer = i
+		out.Data.Base = integer_base(val)
 	}
 
 	self.pop()
@@ -614,6 +2148,9 @@ func normString(s string) (string, error) {
 	for i := 0; i < len(s); {
 		if s[i] == '\\' {
 			i++
+			if i == len(s) {
+				return "", fmt.Errorf("incomplete escape sequence")
+			}
 			switch s[i] {
 			case 'a':
 				dst.WriteByte('\a')
@@ -643,6 +2180,40 @@ func normString(s string) (string, error) {
 				dst.WriteByte('\\')
 				i++
 
+			case '0', '1', '2', '3', '4', '5', '6', '7':
+				// up to 3 octal digits
+				end := i + 1
+				for end < len(s) && end < i+3 && s[end] >= '0' && s[end] <= '7' {
+					end++
+				}
+
+				b, err := str_to_uint(s[i:end], 8)
+				if err != nil {
+					return "", err
+				}
+				if b > 255 {
+					return "", fmt.Errorf("octal escape value %d is bigger than 255", b)
+				}
+				i = end
+
+				dst.WriteByte(byte(b))
+
+			case 'x':
+				i++
+
+				if (i + 2) > len(s) {
+					return "", fmt.Errorf("\\x must be followed by 2 hex digits: \\xHH")
+				}
+
+				b, err := parse_hex(s[i : i+2])
+				if err != nil {
+					return "", fmt.Errorf("\\x must be followed by 2 hex digits: %w", err)
+				}
+				i += 2
+
+				// a raw byte, not a code point
+				dst.WriteByte(byte(b))
+
 			case 'u':
 				i++
 
@@ -650,12 +2221,28 @@ func normString(s string) (string, error) {
 					return "", fmt.Errorf("\\u must be followed by 4 hex digits: \\uXXXX")
 				}
 
-				code, err := str_to_uint(s[i:i+4], 16)
+				code, err := parse_hex(s[i : i+4])
 				if err != nil {
 					return "", err
 				}
 				i += 4
 
+				if is_surrogate(code) {
+					// only a high surrogate followed by a low one is valid
+					var low uint64
+					if code <= 0xdbff && strings.HasPrefix(s[i:], "\\u") && len(s) >= i+6 {
+						low, err = parse_hex(s[i+2 : i+6])
+						if err != nil {
+							return "", err
+						}
+					}
+					if low < 0xdc00 || low > 0xdfff {
+						return "", fmt.Errorf("lone surrogate \\u%04X is not a valid code point, use a surrogate pair or \\UXXXXXXXX for characters above U+FFFF", code)
+					}
+					code = 0x10000 + (code-0xd800)<<10 + (low - 0xdc00)
+					i += 6
+				}
+
 				utf8 := ucs_to_utf8(code)
 				if utf8 == nil {
 					return "", fmt.Errorf("could not encode Unicode code point to UTF-8")
@@ -669,12 +2256,16 @@ func normString(s string) (string, error) {
 					return "", fmt.Errorf("\\U must be followed by 8 hex digits: \\UXXXXXXXX")
 				}
 
-				code, err := str_to_uint(s[i:i+8], 16)
+				code, err := parse_hex(s[i : i+8])
 				if err != nil {
 					return "", err
 				}
 				i += 8
 
+				if is_surrogate(code) {
+					return "", fmt.Errorf("surrogate \\U%08X is not a valid code point", code)
+				}
+
 				utf8 := ucs_to_utf8(code)
 				if utf8 == nil {
 					return "", fmt.Errorf("could not encode Unicode code point to UTF-8")
@@ -694,10 +2285,61 @@ func normString(s string) (string, error) {
 	return dst.String(), nil
 }
 
+// expand_env replaces the ${NAME} and ${NAME:-default} references in s with
+// the values of the environment variables.
+func expand_env(s string) (string, error) {
+	dst := strings.Builder{}
+	for {
+		start := strings.Index(s, "${")
+		if start == -1 {
+			dst.WriteString(s)
+			return dst.String(), nil
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end == -1 {
+			return "", fmt.Errorf("'${' without matching '}'")
+		}
+		end += start
+
+		ref := s[start+2 : end]
+		name, def, hasDef := strings.Cut(ref, ":-")
+		if name == "" {
+			return "", fmt.Errorf("empty variable name")
+		}
+
+		val, ok := os.LookupEnv(name)
+		switch {
+		case hasDef && val == "":
+			val = def
+		case !ok:
+			return "", fmt.Errorf("environment variable '%s' is not set", name)
+		}
+
+		dst.WriteString(s[:start])
+		dst.WriteString(val)
+		s = s[end+1:]
+	}
+}
+
+// parse_hex parses the hex digits of an escape sequence. Unlike str_to_uint
+// it accepts nothing but digits, e.g. no underscores.
+func parse_hex(s string) (uint64, error) {
+	for i := 0; i < len(s); i++ {
+		if !is_digit(s[i]) && (lower(s[i]) < 'a' || lower(s[i]) > 'f') {
+			return 0, fmt.Errorf("invalid hex digit '%c'", s[i])
+		}
+	}
+	return str_to_uint(s, 16)
+}
+
+func is_surrogate(code uint64) bool {
+	return 0xd800 <= code && code <= 0xdfff
+}
+
 // Convert UCS code point to UTF-8
 func ucs_to_utf8(code uint64) []byte {
 	// Code points in the surrogate range are not valid for UTF-8.
-	if 0xd800 <= code && code <= 0xdfff {
+	if is_surrogate(code) {
 		return nil
 	}
 
@@ -755,8 +2397,30 @@ func (self parser) expect_delim(delim byte) bool {
 	return self.get().Value == string(delim)
 }
 
+// found describes the current token, for error messages.
+func (self parser) found() string {
+	if self.i >= len(self.tokens) {
+		return "found nothing"
+	}
+	tok := self.get()
+	return fmt.Sprintf("found %s '%s'", tok.Kind, tok.Value)
+}
+
 func (self *parser) errorf(format string, args ...any) {
-	self.err = fmt.Errorf("%s:%d: error: parse: %s", self.params.file, self.get().Line, fmt.Sprintf(format, args...))
+	// past the end of the tokens, point at the last one
+	var tok Token
+	if self.i < len(self.tokens) {
+		tok = self.get()
+	} else if len(self.tokens) != 0 {
+		tok = self.tokens[len(self.tokens)-1]
+	}
+	self.err = &Error{
+		File:    self.params.file,
+		Line:    tok.Line,
+		Column:  tok.Column,
+		Stage:   "parse",
+		Message: fmt.Sprintf(format, args...),
+	}
 
 	if self.params.flags.AbortOnError {
 		panic(self.err)
@@ -772,16 +2436,40 @@ func is_letter(c byte) bool {
 }
 
 func is_identifier(s string) bool {
-	c := s[0]
-	if c != '_' && !is_letter(c) {
-		return false
+	return s != "" && invalid_identifier_char(s) == -1
+}
+
+// invalid_key_char is like invalid_identifier_char, for a key made of
+// identifiers separated by dots.
+func invalid_key_char(s string) int {
+	start := 0
+	for {
+		seg, _, dotted := strings.Cut(s[start:], ".")
+		if seg == "" {
+			// point at the dot, be it leading, doubled or trailing
+			return min(start, len(s)-1)
+		}
+		if j := invalid_identifier_char(seg); j != -1 {
+			return start + j
+		}
+		if !dotted {
+			return -1
+		}
+		start += len(seg) + 1
 	}
-	for i := 1; i < len(s); i++ {
-		if !is_digit(s[i]) && !is_letter(s[i]) && s[i] != '_' {
-			return false
+}
+
+// invalid_identifier_char returns the index of the first byte of s which
+// can't appear at its position in an identifier, or -1 if there is none.
+func invalid_identifier_char(s string) int {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '_' || is_letter(c) || (i > 0 && is_digit(c)) {
+			continue
 		}
+		return i
 	}
-	return true
+	return -1
 }
 
 func (self parser) get() Token {
@@ -799,56 +2487,256 @@ func (self parser) expect(kind TokenKind) bool {
 }
 
 func (self Table) Dump() {
+	self.DumpTo(os.Stdout)
+}
+
+// DumpTo writes the keys, kinds and values of the table to w.
+func (self Table) DumpTo(w io.Writer) {
 	for _, kv := range self {
 		switch kv.Value.Kind {
 		case ValueKindTable:
-			fmt.Printf("%s %s\n", kv.Key, kv.Value.Kind)
-			kv.Value.Data.Table.Dump()
+			fmt.Fprintf(w, "%s %s\n", kv.Key, kv.Value.Kind)
+			kv.Value.Data.Table.DumpTo(w)
 
 		case ValueKindList:
-			fmt.Printf("%s %s\n", kv.Key, kv.Value.Kind)
-			kv.Value.Data.List.Dump()
+			fmt.Fprintf(w, "%s %s\n", kv.Key, kv.Value.Kind)
+			kv.Value.Data.List.DumpTo(w)
 
 		case ValueKindString:
-			fmt.Printf("%s %s '%s'\n", kv.Key, kv.Value.Kind, kv.Value.Data.String)
+			fmt.Fprintf(w, "%s %s '%s'\n", kv.Key, kv.Value.Kind, kv.Value.Data.String)
 
 		case ValueKindBoolean:
-			fmt.Printf("%s %s %v\n", kv.Key, kv.Value.Kind, kv.Value.Data.Boolean)
+			fmt.Fprintf(w, "%s %s %v\n", kv.Key, kv.Value.Kind, kv.Value.Data.Boolean)
 
 		case ValueKindInteger:
-			fmt.Printf("%s %s %d\n", kv.Key, kv.Value.Kind, kv.Value.Data.Integer)
+			fmt.Fprintf(w, "%s %s %s\n", kv.Key, kv.Value.Kind, kv.Value.FormatInteger(10))
+
+		case ValueKindFloat:
+			fmt.Fprintf(w, "%s %s %s\n", kv.Key, kv.Value.Kind, format_float(kv.Value.Data.Float))
 
 		default:
-			fmt.Printf("%s %s\n", kv.Key, kv.Value.Kind)
+			fmt.Fprintf(w, "%s %s\n", kv.Key, kv.Value.Kind)
 
 		}
 	}
 }
 
 func (self List) Dump() {
+	self.DumpTo(os.Stdout)
+}
+
+// DumpTo writes the kinds and values of the list to w.
+func (self List) DumpTo(w io.Writer) {
 	for _, v := range self {
 		switch v.Kind {
 		case ValueKindTable:
-			fmt.Printf("%s\n", v.Kind)
-			v.Data.Table.Dump()
+			fmt.Fprintf(w, "%s\n", v.Kind)
+			v.Data.Table.DumpTo(w)
 
 		case ValueKindList:
-			fmt.Printf("%s\n", v.Kind)
-			v.Data.List.Dump()
+			fmt.Fprintf(w, "%s\n", v.Kind)
+			v.Data.List.DumpTo(w)
 
 		case ValueKindString:
-			fmt.Printf("%s '%s'\n", v.Kind, v.Data.String)
+			fmt.Fprintf(w, "%s '%s'\n", v.Kind, v.Data.String)
 
 		case ValueKindBoolean:
-			fmt.Printf("%s %v\n", v.Kind, v.Data.Boolean)
+			fmt.Fprintf(w, "%s %v\n", v.Kind, v.Data.Boolean)
 
 		case ValueKindInteger:
-			fmt.Printf("%s %d\n", v.Kind, v.Data.Integer)
+			fmt.Fprintf(w, "%s %s\n", v.Kind, v.FormatInteger(10))
+
+		case ValueKindFloat:
+			fmt.Fprintf(w, "%s %s\n", v.Kind, format_float(v.Data.Float))
 
 		default:
-			fmt.Printf("%s\n", v.Kind)
+			fmt.Fprintf(w, "%s\n", v.Kind)
+
+		}
+	}
+}
+
+// AsInteger returns the value converted to an integer: integers as is,
+// strings holding an integer literal, e.g. "8080" or "0x1f90", and booleans
+// as 0 or 1. Unlike GetInteger, it must be called explicitly to opt in.
+func (self Value) AsInteger() (int64, error) {
+	switch self.Kind {
+	case ValueKindInteger:
+		return self.get_integer()
+	case ValueKindString:
+		n, err := str_to_int(self.Data.String, 0)
+		if err != nil {
+			return 0, fmt.Errorf("string '%s' is not an integer: %w", self.Data.String, err)
+		}
+		return n, nil
+	case ValueKindBoolean:
+		if self.Data.Boolean {
+			return 1, nil
+		}
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("cannot convert %s to integer", self.Kind)
+	}
+}
+
+// AsString returns the text of a scalar value: strings as is, integers in
+// decimal, floats as written by Marshal, booleans as "true" or "false" and
+// null as "null".
+func (self Value) AsString() (string, error) {
+	switch self.Kind {
+	case ValueKindString:
+		return self.Data.String, nil
+	case ValueKindInteger:
+		return self.FormatInteger(10), nil
+	case ValueKindFloat:
+		return format_float(self.Data.Float), nil
+	case ValueKindBoolean:
+		return strconv.FormatBool(self.Data.Boolean), nil
+	case ValueKindNull:
+		return "null", nil
+	default:
+		return "", fmt.Errorf("cannot convert %s to string", self.Kind)
+	}
+}
+
+// IsNull reports whether the value is null.
+func (self Value) IsNull() bool {
+	return self.Kind == ValueKindNull
+}
+
+// is_float reports whether s is a decimal number with a fraction or an
+// exponent, which str_to_float must then accept. It starts with a digit,
+// after an optional sign, so that barewords like yes are not floats.
+func is_float(s string) bool {
+	if len(s) != 0 && (s[0] == '+' || s[0] == '-') {
+		s = s[1:]
+	}
+	if len(s) == 0 || !is_digit(s[0]) || integer_base(s) != 0 {
+		return false
+	}
+	return strings.ContainsAny(s, ".eE")
+}
+
+// str_to_float parses a decimal float: digits, optionally followed by a
+// fraction and an exponent, e.g. -1_000.5e-3. As for integers, underscores
+// may separate digits and there are no leading zeros.
+func str_to_float(s string) (float64, error) {
+	rest := s
+	if len(rest) != 0 && (rest[0] == '+' || rest[0] == '-') {
+		rest = rest[1:]
+	}
+	n, err := float_digits(rest)
+	if err != nil {
+		return 0, err
+	}
+	if n > 1 && rest[0] == '0' {
+		return 0, fmt.Errorf("leading 0 in integer part")
+	}
+	rest = rest[n:]
+	if len(rest) != 0 && rest[0] == '.' {
+		n, err := float_digits(rest[1:])
+		if err != nil {
+			return 0, fmt.Errorf("fraction: %w", err)
+		}
+		rest = rest[1+n:]
+	}
+	if len(rest) != 0 && lower(rest[0]) == 'e' {
+		rest = rest[1:]
+		if len(rest) != 0 && (rest[0] == '+' || rest[0] == '-') {
+			rest = rest[1:]
+		}
+		n, err := float_digits(rest)
+		if err != nil {
+			return 0, fmt.Errorf("exponent: %w", err)
+		}
+		rest = rest[n:]
+	}
+	if len(rest) != 0 {
+		return 0, fmt.Errorf("invalid char '%c'", rest[0])
+	}
 
+	f, err := strconv.ParseFloat(strings.ReplaceAll(s, "_", ""), 64)
+	if err != nil {
+		if errors.Is(err, strconv.ErrRange) {
+			return 0, fmt.Errorf("value out of range")
+		}
+		return 0, err
+	}
+	return f, nil
+}
+
+// float_digits returns the length of the run of digits s starts with,
+// failing if there is none or an underscore is not between digits.
+func float_digits(s string) (int, error) {
+	i := 0
+	for i < len(s) && (is_digit(s[i]) || s[i] == '_') {
+		if s[i] == '_' && (i == 0 || i+1 == len(s) || !is_digit(s[i-1]) || !is_digit(s[i+1])) {
+			return 0, fmt.Errorf("'_' must separate digits")
 		}
+		i++
+	}
+	if i == 0 {
+		return 0, fmt.Errorf("missing digits")
+	}
+	return i, nil
+}
+
+// format_float returns f as a KEVS float, with a fraction or an exponent so
+// that it is not read back as an integer.
+func format_float(f float64) string {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+	return s
+}
+
+// integer_base returns the base of an integer literal, as stored in
+// ValueData.Base.
+func integer_base(s string) uint8 {
+	s = strings.TrimLeft(s, "+-")
+	if len(s) < 2 || s[0] != '0' {
+		return 0
+	}
+	switch s[1] {
+	case 'x':
+		return 16
+	case 'o':
+		return 8
+	case 'b':
+		return 2
+	default:
+		return 0
+	}
+}
+
+// FormatInteger returns the integer value in the given base, 2, 8, 10 or 16,
+// with a 0b, 0o or 0x prefix for non-decimal bases. Other bases are formatted
+// as decimal. The result is empty if the value is not an integer.
+func (self Value) FormatInteger(base int) string {
+	if self.Kind != ValueKindInteger {
+		return ""
+	}
+	n := self.Data.Integer
+	sign := ""
+	// uint64 conversion keeps the magnitude of math.MinInt64
+	u := uint64(n)
+	if n < 0 {
+		sign = "-"
+		u = -u
+	}
+	if self.Data.Uint != 0 {
+		u = self.Data.Uint
+	}
+	switch base {
+	case 2:
+		return sign + "0b" + strconv.FormatUint(u, 2)
+	case 8:
+		return sign + "0o" + strconv.FormatUint(u, 8)
+	case 16:
+		return sign + "0x" + strconv.FormatUint(u, 16)
+	default:
+		return sign + strconv.FormatUint(u, 10)
 	}
 }
 
@@ -897,6 +2785,14 @@ func str_to_uint(s string, base uint64) (uint64, error) {
 	for i := 0; i < len(s); i++ {
 		c := s[i]
 
+		// underscores are allowed only between digits
+		if c == '_' {
+			if i == 0 || i == len(s)-1 || s[i-1] == '_' {
+				return 0, fmt.Errorf("'_' must separate successive digits")
+			}
+			continue
+		}
+
 		d := uint64(0)
 		switch {
 		case is_digit(c):
@@ -938,6 +2834,12 @@ func str_to_int(s string, base uint64) (int64, error) {
 		neg = true
 		s = s[1:]
 	}
+	if len(s) == 0 {
+		return 0, fmt.Errorf("sign must be followed by digits")
+	}
+	if s[0] == '+' || s[0] == '-' {
+		return 0, fmt.Errorf("only one sign is allowed")
+	}
 
 	un, err := str_to_uint(s, base)
 	if err != nil {
@@ -953,13 +2855,79 @@ func str_to_int(s string, base uint64) (int64, error) {
 		return 0, fmt.Errorf("invalid input, underflows min value")
 	}
 
+	if !neg {
+		//nolint overflow checked above
+		return int64(un), nil
+	}
+
+	// un is at most 1<<63, negate in uint64 so min int64 does not overflow
 	//nolint overflow checked above
-	n := int64(un)
-	if neg && n >= 0 {
-		n = -n
+	return int64(-un), nil
+}
+
+var (
+	// ErrKeyNotFound is returned by the getters for a missing key.
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrWrongType is returned, wrapped, by the getters for a value of
+	// another kind than the one asked for, see TypeError.
+	ErrWrongType = errors.New("wrong type")
+)
+
+// TypeError is returned by the getters for a value of the wrong kind.
+type TypeError struct {
+	Expected ValueKind
+	Actual   ValueKind
+}
+
+func (self *TypeError) Error() string {
+	return fmt.Sprintf("value is %s, expected %s", self.Actual, self.Expected)
+}
+
+// Is makes errors.Is(err, ErrWrongType) true for a TypeError.
+func (self *TypeError) Is(target error) bool {
+	return target == ErrWrongType
+}
+
+// Set sets the value of key, replacing the value of an existing key in place
+// or appending a new key-value.
+func (self *Table) Set(key string, v Value) {
+	if i := self.index_of(key, false); i != -1 {
+		(*self)[i].Value = v
+		return
 	}
+	*self = append(*self, KeyValue{Key: key, Value: v})
+}
 
-	return n, nil
+// Delete removes key from the table, keeping the order of the other keys,
+// and reports whether it was found.
+func (self *Table) Delete(key string) bool {
+	i := self.index_of(key, false)
+	if i == -1 {
+		return false
+	}
+	*self = slices.Delete(*self, i, i+1)
+	return true
+}
+
+// GetFold is like Get, but keys differing only in ASCII case match, e.g.
+// "Port" matches "port". The first match is returned.
+func (self Table) GetFold(key string) (Value, bool) {
+	i := self.index_of(key, true)
+	if i == -1 {
+		return Value{}, false
+	}
+	return self[i].Value, true
+}
+
+// Get returns the value of key, of any kind, and whether it was found.
+func (self Table) Get(key string) (Value, bool) {
+	for _, kv := range self {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return Value{}, false
 }
 
 func (self Table) get(key string) (*Value, error) {
@@ -968,120 +2936,969 @@ func (self Table) get(key string) (*Value, error) {
 			return &kv.Value, nil
 		}
 	}
-	return nil, errors.New("key not found")
+	return nil, ErrKeyNotFound
 }
 
 func (self Table) GetString(key string) (string, error) {
-	val, err := self.get(key)
-	if err != nil {
-		return "", err
-	}
-	if val.Kind != ValueKindString {
-		return "", errors.New("value is not string")
-	}
-	return val.Data.String, nil
+	return get_as(self.get, key, (*Value).get_string)
 }
 
 func (self Table) GetInteger(key string) (int64, error) {
-	val, err := self.get(key)
-	if err != nil {
-		return 0, err
-	}
-	if val.Kind != ValueKindInteger {
-		return 0, errors.New("value is not integer")
-	}
-	return val.Data.Integer, nil
+	return get_as(self.get, key, (*Value).get_integer)
+}
+
+// GetUint returns a non-negative integer, including the ones above
+// math.MaxInt64 that GetInteger rejects.
+func (self Table) GetUint(key string) (uint64, error) {
+	return get_as(self.get, key, (*Value).get_uint)
+}
+
+// GetFloat returns a float. Integers are accepted too, converted to the
+// nearest float.
+func (self Table) GetFloat(key string) (float64, error) {
+	return get_as(self.get, key, (*Value).get_float)
 }
 
 func (self Table) GetBoolean(key string) (bool, error) {
-	val, err := self.get(key)
-	if err != nil {
-		return false, err
-	}
-	if val.Kind != ValueKindBoolean {
-		return false, errors.New("value is not boolean")
-	}
-	return val.Data.Boolean, nil
+	return get_as(self.get, key, (*Value).get_boolean)
 }
 
 func (self Table) GetTable(key string) (Table, error) {
-	val, err := self.get(key)
+	return get_as(self.get, key, (*Value).get_table)
+}
+
+func (self Table) GetList(key string) (List, error) {
+	return get_as(self.get, key, (*Value).get_list)
+}
+
+// GetStringDefault returns the string value of key, or def if the key is
+// missing or is not a string.
+func (self Table) GetStringDefault(key, def string) string {
+	v, err := self.GetString(key)
 	if err != nil {
-		return nil, err
+		return def
 	}
-	if val.Kind != ValueKindTable {
-		return nil, errors.New("value is not table")
+	return v
+}
+
+// GetIntegerDefault returns the integer value of key, or def if the key is
+// missing or is not an integer.
+func (self Table) GetIntegerDefault(key string, def int64) int64 {
+	v, err := self.GetInteger(key)
+	if err != nil {
+		return def
 	}
-	return val.Data.Table, nil
+	return v
 }
 
-func (self Table) GetList(key string) (List, error) {
-	val, err := self.get(key)
+// GetFloatDefault returns the float value of key, or def if the key is
+// missing or is not a float or an integer.
+func (self Table) GetFloatDefault(key string, def float64) float64 {
+	v, err := self.GetFloat(key)
 	if err != nil {
-		return nil, err
+		return def
 	}
-	if val.Kind != ValueKindList {
-		return nil, errors.New("value is not list")
+	return v
+}
+
+// GetBooleanDefault returns the boolean value of key, or def if the key is
+// missing or is not a boolean.
+func (self Table) GetBooleanDefault(key string, def bool) bool {
+	v, err := self.GetBoolean(key)
+	if err != nil {
+		return def
 	}
-	return val.Data.List, nil
+	return v
 }
 
-const (
-	reflectTag = "kevs"
-)
+// TableIndex provides constant time lookups of the keys of a table.
+type TableIndex struct {
+	values map[string]*Value
+}
 
-func (self Table) Unmarshal(dst any) error {
-	val := reflect.ValueOf(dst)
-	if val.Type().Kind() != reflect.Pointer || val.Elem().Kind() != reflect.Struct {
-		return errors.New("destination must be a pointer to a struct")
+// Index builds a TableIndex for the table. The index refers to the values
+// of the table, it must be rebuilt if keys are added or removed.
+func (self Table) Index() TableIndex {
+	out := TableIndex{
+		values: make(map[string]*Value, len(self)),
 	}
-	v := reflect.Indirect(val)
-	if !v.CanAddr() {
-		return errors.New("destination cannot be addressed")
+	for i := range self {
+		if _, found := out.values[self[i].Key]; !found {
+			out.values[self[i].Key] = &self[i].Value
+		}
 	}
-	t := v.Type()
-	for i := 0; i < t.NumField(); i++ {
-		f := t.Field(i)
+	return out
+}
+
+func (self TableIndex) get(key string) (*Value, error) {
+	val, found := self.values[key]
+	if !found {
+		return nil, ErrKeyNotFound
+	}
+	return val, nil
+}
+
+func (self TableIndex) GetString(key string) (string, error) {
+	return get_as(self.get, key, (*Value).get_string)
+}
+
+func (self TableIndex) GetInteger(key string) (int64, error) {
+	return get_as(self.get, key, (*Value).get_integer)
+}
+
+// GetUint returns a non-negative integer, including the ones above
+// math.MaxInt64 that GetInteger rejects.
+func (self TableIndex) GetUint(key string) (uint64, error) {
+	return get_as(self.get, key, (*Value).get_uint)
+}
+
+// GetFloat returns a float. Integers are accepted too, converted to the
+// nearest float.
+func (self TableIndex) GetFloat(key string) (float64, error) {
+	return get_as(self.get, key, (*Value).get_float)
+}
+
+func (self TableIndex) GetBoolean(key string) (bool, error) {
+	return get_as(self.get, key, (*Value).get_boolean)
+}
+
+func (self TableIndex) GetTable(key string) (Table, error) {
+	return get_as(self.get, key, (*Value).get_table)
+}
+
+func (self TableIndex) GetList(key string) (List, error) {
+	return get_as(self.get, key, (*Value).get_list)
+}
+
+// GetDuration returns a duration given either as a string accepted by
+// time.ParseDuration, e.g. "30s", or as an integer number of nanoseconds.
+func (self Table) GetDuration(key string) (time.Duration, error) {
+	return get_as(self.get, key, (*Value).get_duration)
+}
+
+// GetTime returns a time given as an RFC 3339 string, e.g.
+// "2024-01-02T15:04:05Z".
+func (self Table) GetTime(key string) (time.Time, error) {
+	return get_as(self.get, key, (*Value).get_time)
+}
+
+// get_as returns the value of key converted by as, the errors naming key.
+func get_as[T any](get func(string) (*Value, error), key string, as func(*Value) (T, error)) (T, error) {
+	val, err := get(key)
+	if err == nil {
+		var out T
+		if out, err = as(val); err == nil {
+			return out, nil
+		}
+	}
+	var zero T
+	return zero, fmt.Errorf("key '%s': %w", key, err)
+}
+
+func (self *Value) get_string() (string, error) {
+	if self.Kind != ValueKindString {
+		return "", &TypeError{Expected: ValueKindString, Actual: self.Kind}
+	}
+	return self.Data.String, nil
+}
+
+func (self *Value) get_integer() (int64, error) {
+	if self.Kind != ValueKindInteger {
+		return 0, &TypeError{Expected: ValueKindInteger, Actual: self.Kind}
+	}
+	if self.Data.Uint != 0 {
+		return 0, fmt.Errorf("value %d overflows int64", self.Data.Uint)
+	}
+	return self.Data.Integer, nil
+}
+
+func (self *Value) get_uint() (uint64, error) {
+	if self.Kind != ValueKindInteger {
+		return 0, &TypeError{Expected: ValueKindInteger, Actual: self.Kind}
+	}
+	if self.Data.Uint != 0 {
+		return self.Data.Uint, nil
+	}
+	if self.Data.Integer < 0 {
+		return 0, fmt.Errorf("negative value %d into unsigned", self.Data.Integer)
+	}
+	return uint64(self.Data.Integer), nil
+}
+
+func (self *Value) get_float() (float64, error) {
+	switch self.Kind {
+	case ValueKindFloat:
+		return self.Data.Float, nil
+	case ValueKindInteger:
+		if self.Data.Uint != 0 {
+			return float64(self.Data.Uint), nil
+		}
+		return float64(self.Data.Integer), nil
+	default:
+		return 0, &TypeError{Expected: ValueKindFloat, Actual: self.Kind}
+	}
+}
+
+func (self *Value) get_boolean() (bool, error) {
+	if self.Kind != ValueKindBoolean {
+		return false, &TypeError{Expected: ValueKindBoolean, Actual: self.Kind}
+	}
+	return self.Data.Boolean, nil
+}
+
+func (self *Value) get_table() (Table, error) {
+	if self.Kind != ValueKindTable {
+		return nil, &TypeError{Expected: ValueKindTable, Actual: self.Kind}
+	}
+	return self.Data.Table, nil
+}
+
+func (self *Value) get_list() (List, error) {
+	if self.Kind != ValueKindList {
+		return nil, &TypeError{Expected: ValueKindList, Actual: self.Kind}
+	}
+	return self.Data.List, nil
+}
+
+func (self *Value) get_duration() (time.Duration, error) {
+	switch self.Kind {
+	case ValueKindString:
+		return time.ParseDuration(self.Data.String)
+	case ValueKindInteger:
+		return time.Duration(self.Data.Integer), nil
+	default:
+		return 0, fmt.Errorf("value is %s, expected string or integer: %w", self.Kind, ErrWrongType)
+	}
+}
+
+func (self *Value) get_time() (time.Time, error) {
+	s, err := self.get_string()
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("value '%s' is not an RFC 3339 time", s)
+	}
+	return t, nil
+}
+
+// lookup returns the value of key. If there is no such key and key is a
+// dotted path, e.g. "server.port", the path is resolved through nested
+// tables instead.
+func (self Table) lookup(key string) (*Value, error) {
+	val, err := self.get(key)
+	if err == nil || !strings.Contains(key, ".") {
+		return val, err
+	}
+	return self.walk(strings.Split(key, "."), false)
+}
+
+// at_line returns " at line N" for the key-value found by lookup for key, or
+// nothing if its line is not known, e.g. in a table built by hand.
+func (self Table) at_line(key string) string {
+	line := 0
+	if i := self.index_of(key, false); i != -1 {
+		line = self[i].Line
+	} else {
+		parts := strings.Split(key, ".")
+		t := self
+		for _, part := range parts[:len(parts)-1] {
+			i := t.index_of(part, false)
+			if i == -1 || t[i].Value.Kind != ValueKindTable {
+				return ""
+			}
+			t = t[i].Value.Data.Table
+		}
+		if i := t.index_of(parts[len(parts)-1], false); i != -1 {
+			line = t[i].Line
+		}
+	}
+	if line == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" at line %d", line)
+}
+
+// GetPath returns the value at path, a dot separated list of keys and list
+// indexes, e.g. "servers.0.host". The error names the first path segment
+// that could not be resolved, and wraps a TypeError if a value on the way
+// is not a table or a list.
+func (self Table) GetPath(path string) (Value, error) {
+	if path == "" {
+		return Value{}, fmt.Errorf("empty path")
+	}
+	val, err := self.walk(strings.Split(path, "."), true)
+	if err != nil {
+		return Value{}, err
+	}
+	return *val, nil
+}
+
+// walk returns the value at the path made of parts, through nested tables
+// and, if lists is set, list elements by index. For a value which is
+// neither, the TypeError expects a list if the next part is an index and a
+// table otherwise.
+func (self Table) walk(parts []string, lists bool) (*Value, error) {
+	cur := &Value{Kind: ValueKindTable}
+	cur.Data.Table = self
+	for i, part := range parts {
+		prefix := strings.Join(parts[:i+1], ".")
+		switch {
+		case cur.Kind == ValueKindTable:
+			val, err := cur.Data.Table.get(part)
+			if err != nil {
+				return nil, fmt.Errorf("path '%s': %w", prefix, err)
+			}
+			cur = val
+		case cur.Kind == ValueKindList && lists:
+			idx, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("path '%s': '%s' is not a list index", prefix, part)
+			}
+			if idx < 0 || idx >= len(cur.Data.List) {
+				return nil, fmt.Errorf("path '%s': index %d out of range, list has %d elements", prefix, idx, len(cur.Data.List))
+			}
+			cur = &cur.Data.List[idx]
+		default:
+			expected := ValueKindTable
+			if _, err := strconv.Atoi(part); err == nil && lists {
+				expected = ValueKindList
+			}
+			return nil, fmt.Errorf("path '%s': %w", strings.Join(parts[:i], "."), &TypeError{Expected: expected, Actual: cur.Kind})
+		}
+	}
+	return cur, nil
+}
+
+// All returns an iterator over the keys and values of the table, in
+// declaration order.
+func (self Table) All() iter.Seq2[string, Value] {
+	return func(yield func(string, Value) bool) {
+		for _, kv := range self {
+			if !yield(kv.Key, kv.Value) {
+				return
+			}
+		}
+	}
+}
+
+// All returns an iterator over the indexes and values of the list.
+func (self List) All() iter.Seq2[int, Value] {
+	return func(yield func(int, Value) bool) {
+		for i, v := range self {
+			if !yield(i, v) {
+				return
+			}
+		}
+	}
+}
+
+// Clone returns a deep copy of the table, sharing no memory with it, so that
+// either can be modified without affecting the other.
+func (self Table) Clone() Table {
+	if self == nil {
+		return nil
+	}
+	out := make(Table, len(self))
+	for i, kv := range self {
+		kv.Value = kv.Value.clone()
+		kv.Comments = slices.Clone(kv.Comments)
+		kv.Trailing = slices.Clone(kv.Trailing)
+		out[i] = kv
+	}
+	return out
+}
+
+// Clone returns a deep copy of the list.
+func (self List) Clone() List {
+	if self == nil {
+		return nil
+	}
+	out := make(List, len(self))
+	for i, v := range self {
+		out[i] = v.clone()
+	}
+	return out
+}
+
+// count returns the number of values in the tree of v, counting up to limit.
+func (self Value) count(limit int) int {
+	n := 1
+	for i := 0; i < len(self.Data.List) && n < limit; i++ {
+		n += self.Data.List[i].count(limit - n)
+	}
+	for i := 0; i < len(self.Data.Table) && n < limit; i++ {
+		n += self.Data.Table[i].Value.count(limit - n)
+	}
+	return n
+}
+
+func (self Value) clone() Value {
+	self.Data.List = self.Data.List.Clone()
+	self.Data.Table = self.Data.Table.Clone()
+	self.Comments = slices.Clone(self.Comments)
+	self.Trailing = slices.Clone(self.Trailing)
+	return self
+}
+
+// ToMap converts the table to native Go values: strings to string, integers
+// to int64, or uint64 above math.MaxInt64, floats to float64, booleans to
+// bool, null to nil, lists to []any and tables to map[string]any. For
+// duplicate keys the last value wins.
+func (self Table) ToMap() map[string]any {
+	out := make(map[string]any, len(self))
+	for _, kv := range self {
+		out[kv.Key] = kv.Value.to_any()
+	}
+	return out
+}
+
+func (self Value) to_any() any {
+	switch self.Kind {
+	case ValueKindString:
+		return self.Data.String
+	case ValueKindInteger:
+		if self.Data.Uint != 0 {
+			return self.Data.Uint
+		}
+		return self.Data.Integer
+	case ValueKindFloat:
+		return self.Data.Float
+	case ValueKindBoolean:
+		return self.Data.Boolean
+	case ValueKindList:
+		out := make([]any, len(self.Data.List))
+		for i, item := range self.Data.List {
+			out[i] = item.to_any()
+		}
+		return out
+	case ValueKindTable:
+		return self.Data.Table.ToMap()
+	default:
+		return nil
+	}
+}
+
+// Walk calls fn for every value of the table, depth-first and in
+// declaration order, tables and lists before their contents. The path holds
+// the keys and list indexes leading to the value; it is reused between
+// calls, so fn must copy it to keep it. An error returned by fn stops the
+// walk and is returned.
+func (self Table) Walk(fn func(path []string, v Value) error) error {
+	return walk_table(self, nil, fn)
+}
+
+func walk_table(t Table, path []string, fn func([]string, Value) error) error {
+	for _, kv := range t {
+		if err := walk_value(kv.Value, append(path, kv.Key), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walk_value(v Value, path []string, fn func([]string, Value) error) error {
+	if err := fn(path, v); err != nil {
+		return err
+	}
+	switch v.Kind {
+	case ValueKindTable:
+		return walk_table(v.Data.Table, path, fn)
+	case ValueKindList:
+		for i, item := range v.Data.List {
+			if err := walk_value(item, append(path, strconv.Itoa(i)), fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Equal reports whether the values have the same kind and data, comparing
+// lists and tables recursively, in order. The base an integer was written
+// in, and the positions and comments of key-values, are ignored.
+func (self Value) Equal(other Value) bool {
+	return equal_values(self, other, false)
+}
+
+// Equal reports whether the tables have the same keys, in the same order,
+// with equal values, see Value.Equal.
+func (self Table) Equal(other Table) bool {
+	return equal_tables(self, other, false)
+}
+
+// EqualUnordered is like Equal, but the order of the keys of this and of the
+// nested tables does not matter. The order of list elements does. Each
+// key-value is matched with a distinct one of the other table, so that
+// tables with duplicate keys are compared one-to-one.
+func (self Table) EqualUnordered(other Table) bool {
+	return equal_tables(self, other, true)
+}
+
+func equal_tables(a, b Table, unordered bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	if !unordered {
+		for i, kv := range a {
+			if kv.Key != b[i].Key || !equal_values(kv.Value, b[i].Value, false) {
+				return false
+			}
+		}
+		return true
+	}
+	// equality is transitive, so matching with the first unused equal
+	// key-value is enough
+	used := make([]bool, len(b))
+	for _, kv := range a {
+		found := false
+		for j := 0; j < len(b) && !found; j++ {
+			if !used[j] && kv.Key == b[j].Key && equal_values(kv.Value, b[j].Value, true) {
+				used[j] = true
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func equal_values(a, b Value, unordered bool) bool {
+	if a.Kind != b.Kind {
+		return false
+	}
+	switch a.Kind {
+	case ValueKindString:
+		return a.Data.String == b.Data.String
+	case ValueKindInteger:
+		return a.Data.Integer == b.Data.Integer && a.Data.Uint == b.Data.Uint
+	case ValueKindBoolean:
+		return a.Data.Boolean == b.Data.Boolean
+	case ValueKindFloat:
+		return a.Data.Float == b.Data.Float
+	case ValueKindList:
+		if len(a.Data.List) != len(b.Data.List) {
+			return false
+		}
+		for i := range a.Data.List {
+			if !equal_values(a.Data.List[i], b.Data.List[i], unordered) {
+				return false
+			}
+		}
+		return true
+	case ValueKindTable:
+		return equal_tables(a.Data.Table, b.Data.Table, unordered)
+	default:
+		return true
+	}
+}
+
+// Merge returns a new table with the key-values of other layered on top of
+// self: keys of other replace or are added to those of self, nested tables
+// are merged recursively and lists are replaced as a whole. Neither table
+// is modified.
+func (self Table) Merge(other Table) Table {
+	out := self.Clone()
+	for _, kv := range other {
+		if cur, ok := out.Get(kv.Key); ok && cur.Kind == ValueKindTable && kv.Value.Kind == ValueKindTable {
+			merged := kv
+			merged.Comments = slices.Clone(kv.Comments)
+			merged.Trailing = slices.Clone(kv.Trailing)
+			merged.Value.Data.Table = cur.Data.Table.Merge(kv.Value.Data.Table)
+			out = out.put(merged)
+			continue
+		}
+		kv.Value = kv.Value.clone()
+		kv.Comments = slices.Clone(kv.Comments)
+		kv.Trailing = slices.Clone(kv.Trailing)
+		out = out.put(kv)
+	}
+	return out
+}
+
+// MatchKeys returns the top-level keys matching the shell pattern, as
+// accepted by path.Match, in declaration order. A malformed pattern matches
+// nothing.
+func (self Table) MatchKeys(pattern string) []string {
+	var out []string
+	for _, kv := range self {
+		if ok, _ := path.Match(pattern, kv.Key); ok {
+			out = append(out, kv.Key)
+		}
+	}
+	return out
+}
+
+// ConflictsWith returns the dotted paths of the values that are defined in
+// both tables, i.e. the values that other would replace when layered on top
+// of self. Nested tables are compared recursively.
+func (self Table) ConflictsWith(other Table) []string {
+	return self.conflicts_with(other, "", nil)
+}
+
+func (self Table) conflicts_with(other Table, prefix string, out []string) []string {
+	for _, kv := range other {
+		val, err := self.get(kv.Key)
+		if err != nil {
+			continue
+		}
+		path := prefix + kv.Key
+		if val.Kind == ValueKindTable && kv.Value.Kind == ValueKindTable {
+			out = val.Data.Table.conflicts_with(kv.Value.Data.Table, path+".", out)
+			continue
+		}
+		out = append(out, path)
+	}
+	return out
+}
+
+// CoerceLike returns a copy of self where string values are converted to the
+// kind the same key has in reference, e.g. to turn environment overrides,
+// which are all strings, into properly typed values. Nested tables are
+// coerced recursively, other values are kept as they are.
+func (self Table) CoerceLike(reference Table) (Table, error) {
+	return self.coerce_like(reference, "")
+}
+
+func (self Table) coerce_like(reference Table, prefix string) (Table, error) {
+	out := make(Table, 0, len(self))
+	for _, kv := range self {
+		ref, err := reference.get(kv.Key)
+		if err != nil {
+			out = append(out, kv)
+			continue
+		}
+		path := prefix + kv.Key
+		switch {
+		case kv.Value.Kind == ValueKindTable && ref.Kind == ValueKindTable:
+			t, err := kv.Value.Data.Table.coerce_like(ref.Data.Table, path+".")
+			if err != nil {
+				return nil, err
+			}
+			kv.Value.Data.Table = t
+
+		case kv.Value.Kind == ValueKindString && ref.Kind == ValueKindInteger:
+			i, err := str_to_int(kv.Value.Data.String, 0)
+			if err != nil {
+				return nil, fmt.Errorf("key '%s': cannot convert '%s' to integer: %w", path, kv.Value.Data.String, err)
+			}
+			kv.Value = Value{Kind: ValueKindInteger}
+			kv.Value.Data.Integer = i
+
+		case kv.Value.Kind == ValueKindString && ref.Kind == ValueKindFloat:
+			f, err := str_to_float(kv.Value.Data.String)
+			if err != nil {
+				return nil, fmt.Errorf("key '%s': cannot convert '%s' to float: %w", path, kv.Value.Data.String, err)
+			}
+			kv.Value = FloatValue(f)
+
+		case kv.Value.Kind == ValueKindString && ref.Kind == ValueKindBoolean:
+			var b bool
+			switch kv.Value.Data.String {
+			case "true":
+				b = true
+			case "false":
+				b = false
+			default:
+				return nil, fmt.Errorf("key '%s': cannot convert '%s' to boolean", path, kv.Value.Data.String)
+			}
+			kv.Value = Value{Kind: ValueKindBoolean}
+			kv.Value.Data.Boolean = b
+		}
+		out = append(out, kv)
+	}
+	return out, nil
+}
+
+const (
+	reflectTag = "kevs"
+)
+
+var (
+	durationType = reflect.TypeFor[time.Duration]()
+	timeType     = reflect.TypeFor[time.Time]()
+)
+
+// tagOptions holds the parsed kevs struct tag of a field, e.g.
+// `kevs:"hosts,minitems=1,maxitems=10"`.
+type tagOptions struct {
+	name      string
+	minItems  int
+	maxItems  int  // negative means unlimited
+	omitEmpty bool // not encoded if empty
+	required  bool // missing or null is an error, even for pointers
+}
+
+func parse_tag(tag string) (tagOptions, error) {
+	name, rest, _ := strings.Cut(tag, ",")
+	out := tagOptions{
+		name:     name,
+		maxItems: -1,
+	}
+	for rest != "" {
+		var opt string
+		opt, rest, _ = strings.Cut(rest, ",")
+		key, val, _ := strings.Cut(opt, "=")
+		switch key {
+		case "minitems", "maxitems":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return out, fmt.Errorf("tag option '%s' needs a non-negative integer", key)
+			}
+			if key == "minitems" {
+				out.minItems = n
+			} else {
+				out.maxItems = n
+			}
+		case "omitempty":
+			out.omitEmpty = true
+		case "required":
+			out.required = true
+		}
+	}
+	return out, nil
+}
+
+// Unmarshaler is implemented by types that decode themselves from a raw KEVS
+// value, e.g. types that map from a list or a table instead of a scalar.
+type Unmarshaler interface {
+	UnmarshalKEVS(v Value) error
+}
+
+// Marshaler is implemented by types that encode themselves into a KEVS value,
+// e.g. a color emitted as a hex string or a set emitted as a list.
+type Marshaler interface {
+	MarshalKEVS() (Value, error)
+}
+
+// as_unmarshaler returns the Unmarshaler implemented by v or by a pointer to v.
+// A nil pointer field is allocated before being returned.
+func as_unmarshaler(v reflect.Value) (Unmarshaler, bool) {
+	if v.Kind() == reflect.Pointer && v.Type().Implements(reflect.TypeFor[Unmarshaler]()) {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		u, ok := v.Interface().(Unmarshaler)
+		return u, ok
+	}
+	if !v.CanAddr() {
+		return nil, false
+	}
+	u, ok := v.Addr().Interface().(Unmarshaler)
+	return u, ok
+}
+
+// Unmarshal stores the table in the struct pointed to by dst. Fields are
+// matched by their kevs tag. A tag can be a dotted path, e.g.
+// `kevs:"server.port"`, to read a value from nested tables; a key that
+// literally matches the whole tag takes precedence over the path.
+// Fields tagged `kevs:"-"` are skipped, as are untagged fields other than
+// embedded structs, whose fields are promoted.
+// Optional values are modeled with pointer fields, which are set to nil
+// when their key is missing or null; other fields are zeroed by a null. The
+// same goes for list elements, e.g. [ 1; null; ] is []*int{&1, nil}. A
+// field tagged with the required option, e.g. `kevs:"host,required"`, must
+// have a value: its key missing or null is an error.
+func (self Table) Unmarshal(dst any) error {
+	val := reflect.ValueOf(dst)
+	if val.Type().Kind() != reflect.Pointer || val.Elem().Kind() != reflect.Struct {
+		return errors.New("destination must be a pointer to a struct")
+	}
+	v := reflect.Indirect(val)
+	if !v.CanAddr() {
+		return errors.New("destination cannot be addressed")
+	}
+	return self.unmarshal_struct(v, []reflect.Type{v.Type()})
+}
+
+// embedded_struct returns the struct type of field f, and whether f is an
+// untagged embedded struct, or pointer to struct, whose fields are promoted.
+func embedded_struct(f reflect.StructField) (reflect.Type, bool) {
+	if !f.Anonymous {
+		return nil, false
+	}
+	if _, found := f.Tag.Lookup(reflectTag); found {
+		return nil, false
+	}
+	t := f.Type
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t, t.Kind() == reflect.Struct
+}
+
+// promoted_keys returns the keys of the tagged fields of the struct type t,
+// including those promoted from its embedded structs. The types in path are
+// being walked and are skipped.
+func promoted_keys(t reflect.Type, path []reflect.Type) []string {
+	var out []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if et, ok := embedded_struct(f); ok {
+			if !slices.Contains(path, et) {
+				out = append(out, promoted_keys(et, append(slices.Clip(path), et))...)
+			}
+			continue
+		}
+		tag, found := f.Tag.Lookup(reflectTag)
+		if !f.IsExported() || !found || tag == "-" {
+			continue
+		}
+		// a bad tag is reported when unmarshaling the field
+		if opts, err := parse_tag(tag); err == nil {
+			out = append(out, opts.name)
+		}
+	}
+	return out
+}
+
+// unmarshal_struct stores the table in the struct v. path holds the types
+// of v and of the structs embedding it, whose fields are already matched:
+// an embedded struct of one of these types is skipped, e.g. in
+// type Node struct { *Node; X int }.
+func (self Table) unmarshal_struct(v reflect.Value, path []reflect.Type) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if et, ok := embedded_struct(f); ok {
+			if slices.Contains(path, et) {
+				continue
+			}
+			inner := append(slices.Clip(path), et)
+			fv := v.Field(i)
+			if fv.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					// allocated only if one of its keys is there
+					if !fv.CanSet() || !self.has_any(promoted_keys(et, inner)) {
+						continue
+					}
+					fv.Set(reflect.New(et))
+				}
+				fv = fv.Elem()
+			}
+			if err := self.unmarshal_struct(fv, inner); err != nil {
+				return err
+			}
+			continue
+		}
 		if !f.IsExported() {
 			continue
 		}
-		name, found := f.Tag.Lookup(reflectTag)
-		if !found {
+		tag, found := f.Tag.Lookup(reflectTag)
+		if !found || tag == "-" {
+			continue
+		}
+		opts, err := parse_tag(tag)
+		if err != nil {
+			return fmt.Errorf("struct '%s': field '%s': %w", t.Name(), f.Name, err)
+		}
+		name := opts.name
+		fv := v.Field(i)
+		vv, err := self.lookup(name)
+		if err != nil {
+			// optional values are modeled with pointers
+			if errors.Is(err, ErrKeyNotFound) && fv.Kind() == reflect.Pointer && !opts.required {
+				fv.SetZero()
+				continue
+			}
+			return fmt.Errorf("struct '%s': field '%s': %w", t.Name(), f.Name, err)
+		}
+		// null is like a missing key for pointers, and the zero value
+		// for the rest
+		if vv.IsNull() {
+			if opts.required {
+				return fmt.Errorf("struct '%s': field '%s': required value is null", t.Name(), f.Name)
+			}
+			fv.SetZero()
 			continue
 		}
-		switch f.Type.Kind() {
+		if u, ok := as_unmarshaler(fv); ok {
+			if err := u.UnmarshalKEVS(*vv); err != nil {
+				return fmt.Errorf("struct '%s': field '%s': %w", t.Name(), f.Name, err)
+			}
+			continue
+		}
+		if fv.Kind() == reflect.Pointer {
+			fv.Set(reflect.New(fv.Type().Elem()))
+			fv = fv.Elem()
+		}
+		if fv.Type() == timeType {
+			tm, err := vv.get_time()
+			if err != nil {
+				return fmt.Errorf("struct '%s': field '%s': %w", t.Name(), f.Name, err)
+			}
+			fv.Set(reflect.ValueOf(tm))
+			continue
+		}
+		if fv.Type() == durationType {
+			d, err := vv.get_duration()
+			if err != nil {
+				return fmt.Errorf("struct '%s': field '%s': %w", t.Name(), f.Name, err)
+			}
+			fv.SetInt(int64(d))
+			continue
+		}
+		switch fv.Kind() {
 		case reflect.String:
-			vv, err := self.GetString(name)
+			s, err := vv.get_string()
 			if err != nil {
 				return fmt.Errorf("struct '%s': field '%s': %w", t.Name(), f.Name, err)
 			}
-			v.Field(i).SetString(vv)
-		case reflect.Int:
-			vv, err := self.GetInteger(name)
+			fv.SetString(s)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n, err := vv.get_integer()
 			if err != nil {
 				return fmt.Errorf("struct '%s': field '%s': %w", t.Name(), f.Name, err)
 			}
-			v.Field(i).SetInt(vv)
-		case reflect.Bool:
-			vv, err := self.GetBoolean(name)
+			if fv.OverflowInt(n) {
+				return fmt.Errorf("struct '%s': field '%s': value %d overflows %s", t.Name(), f.Name, n, fv.Type())
+			}
+			fv.SetInt(n)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n, err := vv.get_uint()
 			if err != nil {
 				return fmt.Errorf("struct '%s': field '%s': %w", t.Name(), f.Name, err)
 			}
-			v.Field(i).SetBool(vv)
-		case reflect.Slice, reflect.Array:
-			vv, err := self.GetList(name)
+			if fv.OverflowUint(n) {
+				return fmt.Errorf("struct '%s': field '%s': value %d overflows %s", t.Name(), f.Name, n, fv.Type())
+			}
+			fv.SetUint(n)
+		case reflect.Float32, reflect.Float64:
+			x, err := vv.get_float()
 			if err != nil {
 				return fmt.Errorf("struct '%s': field '%s': %w", t.Name(), f.Name, err)
 			}
-			if err := vv.unmarshal(v.Field(i)); err != nil {
-				return err
+			if fv.OverflowFloat(x) {
+				return fmt.Errorf("struct '%s': field '%s': value %g overflows %s", t.Name(), f.Name, x, fv.Type())
 			}
-		case reflect.Struct:
-			vv, err := self.GetTable(name)
+			fv.SetFloat(x)
+		case reflect.Bool:
+			b, err := vv.get_boolean()
 			if err != nil {
 				return fmt.Errorf("struct '%s': field '%s': %w", t.Name(), f.Name, err)
 			}
-			if err := vv.Unmarshal(v.Field(i).Addr().Interface()); err != nil {
+			fv.SetBool(b)
+		case reflect.Slice, reflect.Array:
+			if vv.Kind != ValueKindList {
+				return fmt.Errorf("struct '%s': field '%s': expected %s, got %s%s", t.Name(), f.Name, ValueKindList, vv.Kind, self.at_line(name))
+			}
+			if err := vv.Data.List.unmarshal(fv); err != nil {
+				return err
+			}
+			if n := len(vv.Data.List); n < opts.minItems {
+				return fmt.Errorf("struct '%s': field '%s': %d items is below minimum of %d", t.Name(), f.Name, n, opts.minItems)
+			}
+			if n := len(vv.Data.List); opts.maxItems >= 0 && n > opts.maxItems {
+				return fmt.Errorf("struct '%s': field '%s': %d items exceeds maximum of %d", t.Name(), f.Name, n, opts.maxItems)
+			}
+		case reflect.Struct:
+			if vv.Kind != ValueKindTable {
+				return fmt.Errorf("struct '%s': field '%s': expected %s, got %s%s", t.Name(), f.Name, ValueKindTable, vv.Kind, self.at_line(name))
+			}
+			if err := vv.Data.Table.Unmarshal(fv.Addr().Interface()); err != nil {
 				return err
 			}
 		default:
@@ -1091,24 +3908,234 @@ func (self Table) Unmarshal(dst any) error {
 	return nil
 }
 
+// has_any reports whether one of the keys, which can be dotted paths, is
+// in the table.
+func (self Table) has_any(keys []string) bool {
+	for _, key := range keys {
+		if _, err := self.lookup(key); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalStrict is like Unmarshal, but also fails if the table, or any
+// table decoded into a nested struct, has keys that no field matches. All
+// the unknown keys are reported together, as dotted paths.
+func (self Table) UnmarshalStrict(dst any) error {
+	if err := self.Unmarshal(dst); err != nil {
+		return err
+	}
+	t := reflect.TypeOf(dst).Elem()
+	nodes := make(map[string]*fieldNode)
+	struct_fields(t, nodes, []reflect.Type{t})
+	unknown := unknown_keys(self, nodes, "")
+	if len(unknown) == 0 {
+		return nil
+	}
+	return fmt.Errorf("struct '%s': unknown keys: '%s'", t.Name(), strings.Join(unknown, "', '"))
+}
+
+// fieldNode is a key that a struct expects, for UnmarshalStrict.
+type fieldNode struct {
+	typ      reflect.Type          // nil for the tables of dotted tags
+	children map[string]*fieldNode // from dotted tags
+}
+
+// struct_fields adds to nodes the keys that the struct type t expects, as
+// matched by Unmarshal. The embedded structs of the types in path are
+// skipped, see unmarshal_struct.
+func struct_fields(t reflect.Type, nodes map[string]*fieldNode, path []reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if et, ok := embedded_struct(f); ok {
+			if !slices.Contains(path, et) {
+				struct_fields(et, nodes, append(slices.Clip(path), et))
+			}
+			continue
+		}
+		tag, found := f.Tag.Lookup(reflectTag)
+		if !f.IsExported() || !found || tag == "-" {
+			continue
+		}
+		opts, err := parse_tag(tag)
+		if err != nil {
+			continue
+		}
+		add_field(nodes, opts.name).typ = f.Type
+		parts := strings.Split(opts.name, ".")
+		cur := nodes
+		for _, part := range parts[:len(parts)-1] {
+			n := add_field(cur, part)
+			if n.children == nil {
+				n.children = make(map[string]*fieldNode)
+			}
+			cur = n.children
+		}
+		if len(parts) > 1 {
+			add_field(cur, parts[len(parts)-1]).typ = f.Type
+		}
+	}
+}
+
+// add_field returns the node of key, adding it if needed.
+func add_field(nodes map[string]*fieldNode, key string) *fieldNode {
+	n := nodes[key]
+	if n == nil {
+		n = &fieldNode{}
+		nodes[key] = n
+	}
+	return n
+}
+
+// unknown_keys returns the paths of the keys of t that are not in nodes.
+func unknown_keys(t Table, nodes map[string]*fieldNode, prefix string) []string {
+	var out []string
+	for _, kv := range t {
+		name := prefix + kv.Key
+		n, ok := nodes[kv.Key]
+		if !ok {
+			out = append(out, name)
+			continue
+		}
+		out = append(out, unknown_in_value(kv.Value, n, name)...)
+	}
+	return out
+}
+
+func unknown_in_value(v Value, n *fieldNode, name string) []string {
+	typ := n.typ
+	for typ != nil && typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	if typ != nil && reflect.PointerTo(typ).Implements(reflect.TypeFor[Unmarshaler]()) {
+		// decoded by the type itself
+		return nil
+	}
+	switch {
+	case v.Kind == ValueKindTable && (n.children != nil || typ != nil && typ.Kind() == reflect.Struct):
+		nodes := make(map[string]*fieldNode)
+		for k, c := range n.children {
+			nodes[k] = c
+		}
+		if typ != nil && typ.Kind() == reflect.Struct {
+			struct_fields(typ, nodes, []reflect.Type{typ})
+		}
+		return unknown_keys(v.Data.Table, nodes, name+".")
+	case v.Kind == ValueKindList && typ != nil && (typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array):
+		var out []string
+		elem := &fieldNode{typ: typ.Elem()}
+		for i, item := range v.Data.List {
+			out = append(out, unknown_in_value(item, elem, name+"."+strconv.Itoa(i))...)
+		}
+		return out
+	default:
+		return nil
+	}
+}
+
 func (self List) unmarshal(v reflect.Value) error {
 	slice := reflect.MakeSlice(v.Type(), len(self), len(self))
 	for i, item := range self {
 		elem := slice.Index(i)
+		if item.IsNull() {
+			// left to the zero value, like a field
+			continue
+		}
+		if elem.Kind() == reflect.Pointer {
+			elem.Set(reflect.New(elem.Type().Elem()))
+			elem = elem.Elem()
+		}
+		if u, ok := as_unmarshaler(elem); ok {
+			if err := u.UnmarshalKEVS(item); err != nil {
+				return fmt.Errorf("element %d: %w", i, err)
+			}
+			continue
+		}
 		switch {
 		case item.Kind == ValueKindString && elem.Kind() == reflect.String:
 			elem.SetString(item.Data.String)
-		case item.Kind == ValueKindInteger && elem.Kind() == reflect.Int:
-			elem.SetInt(item.Data.Integer)
+		case item.Kind == ValueKindInteger && is_int_kind(elem.Kind()):
+			n, err := item.get_integer()
+			if err != nil {
+				return fmt.Errorf("element %d: %w", i, err)
+			}
+			if elem.OverflowInt(n) {
+				return fmt.Errorf("element %d: value %d overflows %s", i, n, elem.Type())
+			}
+			elem.SetInt(n)
+		case item.Kind == ValueKindInteger && is_uint_kind(elem.Kind()):
+			n, err := item.get_uint()
+			if err != nil {
+				return fmt.Errorf("element %d: %w", i, err)
+			}
+			if elem.OverflowUint(n) {
+				return fmt.Errorf("element %d: value %d overflows %s", i, n, elem.Type())
+			}
+			elem.SetUint(n)
+		case (item.Kind == ValueKindFloat || item.Kind == ValueKindInteger) && is_float_kind(elem.Kind()):
+			f, _ := item.get_float()
+			if elem.OverflowFloat(f) {
+				return fmt.Errorf("element %d: value %g overflows %s", i, f, elem.Type())
+			}
+			elem.SetFloat(f)
 		case item.Kind == ValueKindBoolean && elem.Kind() == reflect.Bool:
 			elem.SetBool(item.Data.Boolean)
+		case item.Kind == ValueKindList && elem.Kind() == reflect.Slice:
+			if err := item.Data.List.unmarshal(elem); err != nil {
+				return fmt.Errorf("element %d: %w", i, err)
+			}
 		case item.Kind == ValueKindTable && elem.Kind() == reflect.Struct:
 			err := item.Data.Table.Unmarshal(elem.Addr().Interface())
 			if err != nil {
-				return err
+				return fmt.Errorf("element %d: %w", i, err)
 			}
+		default:
+			return fmt.Errorf("element %d: expected %s, got %s", i, value_kind_of(elem.Type()), item.Kind)
 		}
 	}
 	v.Set(slice)
 	return nil
 }
+
+// value_kind_of returns the kind of value that can be stored in type t.
+func value_kind_of(t reflect.Type) ValueKind {
+	switch k := t.Kind(); {
+	case k == reflect.String:
+		return ValueKindString
+	case is_int_kind(k) || is_uint_kind(k):
+		return ValueKindInteger
+	case is_float_kind(k):
+		return ValueKindFloat
+	case k == reflect.Bool:
+		return ValueKindBoolean
+	case k == reflect.Slice:
+		return ValueKindList
+	case k == reflect.Struct:
+		return ValueKindTable
+	default:
+		return ValueKindUndefined
+	}
+}
+
+func is_int_kind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	default:
+		return false
+	}
+}
+
+func is_float_kind(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+func is_uint_kind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	default:
+		return false
+	}
+}
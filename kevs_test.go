@@ -3,7 +3,18 @@ package kevs
 import (
 	"bytes"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_ucs_to_utf8(t *testing.T) {
@@ -112,7 +123,3851 @@ struct = { x = 2; y = "3"; };
 
 }
 
-// TODO: test list of structs
+type point struct {
+	X, Y int64
+}
+
+func (self *point) UnmarshalKEVS(v Value) error {
+	if v.Kind != ValueKindList || len(v.Data.List) != 2 {
+		return errors.New("point must be a list of two integers")
+	}
+	self.X = v.Data.List[0].Data.Integer
+	self.Y = v.Data.List[1].Data.Integer
+	return nil
+}
+
+func TestUnmarshalUnmarshaler(t *testing.T) {
+	type data struct {
+		Origin point   `kevs:"origin"`
+		End    *point  `kevs:"end"`
+		Path   []point `kevs:"path"`
+	}
+
+	content := `
+origin = [ 1; 2; ];
+end = [ 3; 4; ];
+path = [ [ 5; 6; ]; [ 7; 8; ]; ];
+`
+
+	root, err := Parse("none", content, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d data
+	if err := root.Unmarshal(&d); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Origin != (point{1, 2}) {
+		t.Fatal("fail")
+	}
+	if d.End == nil || *d.End != (point{3, 4}) {
+		t.Fatal("fail")
+	}
+	if len(d.Path) != 2 || d.Path[0] != (point{5, 6}) || d.Path[1] != (point{7, 8}) {
+		t.Fatal("fail")
+	}
+
+	root, err = Parse("none", `origin = 1;`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var o struct {
+		Origin point `kevs:"origin"`
+	}
+	if err := root.Unmarshal(&o); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
 // TODO: test struct of lists
-// TODO: test list of lists
-// TODO: test list with different elem types
+
+func TestParseWithStats(t *testing.T) {
+	tests := []struct {
+		content  string
+		keys     int
+		comments int
+	}{
+		{"", 0, 0},
+		{"# a = 1;\n# b = 2;\n", 0, 2},
+		{"a = 1;\n# b = 2;\n", 1, 1},
+	}
+
+	for _, test := range tests {
+		root, stats, err := ParseWithStats("none", test.content, Flags{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(root) != test.keys {
+			t.Errorf("keys: want %d, have %d", test.keys, len(root))
+		}
+		if stats.CommentCount != test.comments {
+			t.Errorf("comments: want %d, have %d", test.comments, stats.CommentCount)
+		}
+	}
+}
+
+func TestMaxStringLength(t *testing.T) {
+	tests := []struct {
+		content string
+		ok      bool
+	}{
+		{`a = "abcd";`, true},
+		{`a = "abcde";`, false},
+		{"a = `abcd`;", true},
+		{"a = `abcde`;", false},
+	}
+
+	for _, test := range tests {
+		_, err := Parse("none", test.content, Flags{MaxStringLength: 4})
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.content, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: expected error", test.content)
+		}
+	}
+
+	if _, err := Parse("none", `a = "abcde";`, Flags{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Parse("none", "a = 1;\nb = \"abcde\";", Flags{MaxStringLength: 4})
+	want := "none:2:5: error: scan: string value exceeds maximum length of 4 bytes"
+	if err == nil || err.Error() != want {
+		t.Fatalf("want error %q, have %v", want, err)
+	}
+}
+
+func TestParseSection(t *testing.T) {
+	content := `
+before = { a = [ 1; { b = 2; }; ]; };
+server = { host = "a"; port = 1; };
+after = [ "x"; ];
+`
+
+	v, err := ParseSection("none", content, "server", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Kind != ValueKindTable {
+		t.Fatal("fail")
+	}
+	port, err := v.Data.Table.GetInteger("port")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 1 {
+		t.Fatal("fail")
+	}
+
+	v, err = ParseSection("none", content, "after", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Kind != ValueKindList || len(v.Data.List) != 1 {
+		t.Fatal("fail")
+	}
+
+	if _, err := ParseSection("none", content, "missing", Flags{}); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := ParseSection("none", content, "server.user", Flags{}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestParseSectionDotted(t *testing.T) {
+	content := `
+server.host = "a";
+other = 1;
+server.db = { port = 2; };
+`
+
+	v, err := ParseSection("none", content, "server", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := v.Data.Table.GetString("host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "a" {
+		t.Fatal("fail")
+	}
+
+	v, err = ParseSection("none", content, "server.db.port", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Kind != ValueKindInteger || v.Data.Integer != 2 {
+		t.Fatal("fail")
+	}
+
+	if _, err := ParseSection("none", content, "SERVER.DB", Flags{}); err == nil {
+		t.Fatal("expected error")
+	}
+	v, err = ParseSection("none", content, "SERVER.DB", Flags{CaseInsensitiveKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Kind != ValueKindTable {
+		t.Fatal("fail")
+	}
+}
+
+func TestUnmarshalKindMismatch(t *testing.T) {
+	type server struct {
+		Host string `kevs:"host"`
+	}
+
+	root, err := Parse("none", `servers = { host = "a"; };`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var l struct {
+		Servers []server `kevs:"servers"`
+	}
+	err = root.Unmarshal(&l)
+	if err == nil || err.Error() != "struct '': field 'Servers': expected list, got table at line 1" {
+		t.Fatal("unexpected error:", err)
+	}
+
+	root, err = Parse("none", "name = \"x\";\nmain = [ \"a\"; ];", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s struct {
+		Main server `kevs:"main"`
+	}
+	err = root.Unmarshal(&s)
+	if err == nil || err.Error() != "struct '': field 'Main': expected table, got list at line 2" {
+		t.Fatal("unexpected error:", err)
+	}
+
+	root, err = Parse("none", "a = {\n    b = {\n        main = [];\n    };\n};", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nested struct {
+		Main server `kevs:"a.b.main"`
+	}
+	err = root.Unmarshal(&nested)
+	if err == nil || err.Error() != "struct '': field 'Main': expected table, got list at line 3" {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// no line for tables built by hand
+	built := Table{{Key: "main", Value: Value{Kind: ValueKindList}}}
+	err = built.Unmarshal(&s)
+	if err == nil || err.Error() != "struct '': field 'Main': expected table, got list" {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestConflictsWith(t *testing.T) {
+	base, err := Parse("none", `
+name = "base";
+server = { host = "a"; port = 1; };
+tags = [ "x"; ];
+`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	overlay, err := Parse("none", `
+server = { port = 2; tls = true; };
+tags = { a = 1; };
+debug = true;
+`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have := base.ConflictsWith(overlay)
+	want := []string{"server.port", "tags"}
+	if !slices.Equal(have, want) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+}
+
+func TestCoerceLike(t *testing.T) {
+	reference, err := Parse("none", `
+port = 80;
+debug = false;
+name = "x";
+db = { pool = 4; };
+`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := Parse("none", `
+port = "8080";
+debug = "true";
+name = "y";
+db = { pool = "0x10"; };
+extra = "1";
+`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := env.CoerceLike(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := out.GetInteger("port"); err != nil || v != 8080 {
+		t.Fatal("port:", v, err)
+	}
+	if v, err := out.GetBoolean("debug"); err != nil || v != true {
+		t.Fatal("debug:", v, err)
+	}
+	if v, err := out.GetString("name"); err != nil || v != "y" {
+		t.Fatal("name:", v, err)
+	}
+	if v, err := out.GetString("extra"); err != nil || v != "1" {
+		t.Fatal("extra:", v, err)
+	}
+	db, err := out.GetTable("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.GetInteger("pool"); err != nil || v != 16 {
+		t.Fatal("pool:", v, err)
+	}
+
+	// the input must not be modified
+	if v, err := env.GetString("port"); err != nil || v != "8080" {
+		t.Fatal("port:", v, err)
+	}
+
+	bad, err := Parse("none", `db = { pool = "many"; };`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bad.CoerceLike(reference)
+	if err == nil || !strings.Contains(err.Error(), "key 'db.pool'") {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestAnonymousSections(t *testing.T) {
+	content := `
+{ id = 1; }
+{ id = 2; };
+[ "a"; ]
+`
+
+	root, err := Parse("none", content, Flags{AnonymousSections: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(root) != 3 {
+		t.Fatal("fail")
+	}
+	for i, key := range []string{"_0", "_1", "_2"} {
+		if root[i].Key != key {
+			t.Fatalf("want %s, have %s", key, root[i].Key)
+		}
+	}
+	if root[2].Value.Kind != ValueKindList {
+		t.Fatal("fail")
+	}
+
+	if _, err := Parse("none", content, Flags{}); err == nil {
+		t.Fatal("expected error without flag")
+	}
+
+	// synthetic keys never replace real ones, nor the other way around
+	for _, in := range []string{
+		"_0 = 1;\n{ id = 1; }\n",
+		"{ id = 1; }\n_0 = 1;\n",
+		"_0.x = 1;\n{ id = 1; }\n",
+		"{ id = 1; }\n_0.x = 1;\n",
+	} {
+		for _, dup := range []bool{false, true} {
+			_, err = Parse("none", in, Flags{AnonymousSections: true, AllowDuplicateKeys: dup})
+			if err == nil || !strings.Contains(err.Error(), "key '_0' clashes with the synthetic key of an anonymous section") {
+				t.Fatalf("%q: unexpected error: %v", in, err)
+			}
+		}
+	}
+
+	// real keys are checked as usual
+	root, err = Parse("none", "_1 = 1;\n{ id = 1; }\n", Flags{AnonymousSections: true})
+	if err != nil || len(root) != 2 || root[1].Key != "_0" {
+		t.Fatal("unexpected result:", root, err)
+	}
+	if _, err := Parse("none", "{ _0 = 1; _0 = 2; }\n", Flags{AnonymousSections: true, AllowDuplicateKeys: true}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnmarshalListLength(t *testing.T) {
+	type data struct {
+		Hosts []string `kevs:"hosts,minitems=1,maxitems=2"`
+	}
+
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{`hosts = [ "a"; ];`, ""},
+		{`hosts = [ "a"; "b"; ];`, ""},
+		{`hosts = [];`, "struct 'data': field 'Hosts': 0 items is below minimum of 1"},
+		{`hosts = [ "a"; "b"; "c"; ];`, "struct 'data': field 'Hosts': 3 items exceeds maximum of 2"},
+	}
+
+	for _, test := range tests {
+		root, err := Parse("none", test.content, Flags{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var d data
+		err = root.Unmarshal(&d)
+		if test.err == "" && err != nil {
+			t.Errorf("%s: %v", test.content, err)
+		}
+		if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%s: want %q, have %v", test.content, test.err, err)
+		}
+	}
+
+	var bad struct {
+		Hosts []string `kevs:"hosts,maxitems=x"`
+	}
+	root, err := Parse("none", `hosts = [];`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Unmarshal(&bad); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestKeepSpace(t *testing.T) {
+	tokens, err := Scan("none", "a =\t1;\n  b  = [ 2 ;];\n", Flags{KeepSpace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"", " ", "\t", "", "  ", "  ", " ", " ", " ", "", ""}
+	if len(tokens) != len(want) {
+		t.Fatalf("want %d tokens, have %d", len(want), len(tokens))
+	}
+	for i, tok := range tokens {
+		if tok.Space != want[i] {
+			t.Errorf("token %d '%s': want %q, have %q", i, tok.Value, want[i], tok.Space)
+		}
+	}
+
+	tokens, err = Scan("none", "a =\t1;\n", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tok := range tokens {
+		if tok.Space != "" {
+			t.Fatal("space recorded without flag")
+		}
+	}
+}
+
+func TestIdentifierFunc(t *testing.T) {
+	flags := Flags{
+		IdentifierFunc: func(s string) bool {
+			return is_letter(s[0]) && len(s) <= 8 && !strings.Contains(s, "__")
+		},
+	}
+
+	if _, err := Parse("none", "a_b = 1;\n", flags); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []string{
+		"_a = 1;\n",
+		"a__b = 1;\n",
+		"abcdefghi = 1;\n",
+	}
+	for _, test := range tests {
+		_, err := Parse("none", test, flags)
+		if err == nil || !strings.Contains(err.Error(), "none:1:1: error: parse: key is not a valid identifier") {
+			t.Errorf("%s: unexpected error: %v", test, err)
+		}
+	}
+
+	if _, err := Parse("none", "_a = 1;\n", Flags{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmptyString(t *testing.T) {
+	root, err := Parse("none", "x = \"\";\ny = ``;\n", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"x", "y"} {
+		v, err := root.GetString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != "" {
+			t.Fatalf("%s: want empty string, have %q", key, v)
+		}
+	}
+
+	out, err := Canonicalize("x = \"\";\ny = ``;\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "x = \"\";\ny = \"\";\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	if _, err := normString(`\`); err == nil {
+		t.Fatal("expected error for trailing backslash")
+	}
+}
+
+func TestAll(t *testing.T) {
+	root, err := Parse("none", "a = 1;\nb = [ 2; 3; 4; ];\nc = 5;\n", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for k, v := range root.All() {
+		if k == "c" {
+			break
+		}
+		keys = append(keys, k)
+		if k == "b" {
+			var items []int64
+			for i, item := range v.Data.List.All() {
+				if i == 2 {
+					break
+				}
+				items = append(items, item.Data.Integer)
+			}
+			if !slices.Equal(items, []int64{2, 3}) {
+				t.Fatal("unexpected items:", items)
+			}
+		}
+	}
+	if !slices.Equal(keys, []string{"a", "b"}) {
+		t.Fatal("unexpected keys:", keys)
+	}
+}
+
+func TestStrictRawStrings(t *testing.T) {
+	flags := Flags{StrictRawStrings: true}
+
+	if _, err := Parse("none", "a = `x\ty\nz`;\n", flags); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Parse("none", "a = `x\ny\x1bz`;\n", flags)
+	want := "none:2:2: error: scan: raw string contains control character 0x1b at offset 3"
+	if err == nil || err.Error() != want {
+		t.Fatalf("want %q, have %v", want, err)
+	}
+
+	if _, err := Parse("none", "a = `x\x1bz`;\n", Flags{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnmarshalPath(t *testing.T) {
+	type data struct {
+		Host string `kevs:"server.host"`
+		Port int    `kevs:"server.tls.port"`
+	}
+
+	root, err := Parse("none", `server = { host = "a"; tls = { port = 443; }; };`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d data
+	if err := root.Unmarshal(&d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Host != "a" || d.Port != 443 {
+		t.Fatal("fail:", d)
+	}
+
+	root, err = Parse("none", `server = { host = "a"; tls = 1; };`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = root.Unmarshal(&d)
+	if err == nil || !strings.Contains(err.Error(), "path 'server.tls': value is integer, expected table") {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestCountElements(t *testing.T) {
+	content := `
+name = "x";
+hosts = [
+    "a";
+    [ 1; 2; 3; ];
+    { x = 1; y = [ 4; ]; };
+];
+empty = [];
+`
+
+	tests := []struct {
+		key string
+		n   int
+	}{
+		{"hosts", 3},
+		{"empty", 0},
+	}
+	for _, test := range tests {
+		n, err := CountElements("none", content, test.key, Flags{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != test.n {
+			t.Errorf("%s: want %d, have %d", test.key, test.n, n)
+		}
+	}
+
+	if _, err := CountElements("none", content, "name", Flags{}); err == nil {
+		t.Fatal("expected error for non-list value")
+	}
+	if _, err := CountElements("none", content, "missing", Flags{}); err == nil {
+		t.Fatal("expected error for missing key")
+	}
+}
+
+func TestCountElementsDotted(t *testing.T) {
+	content := `
+a.b = [ 1; 2; ];
+c = { d = { e = [ 1; 2; 3; ]; }; f = []; };
+g = [ 1; ];
+g = [ 1; 2; 3; 4; ];
+`
+
+	tests := []struct {
+		key   string
+		flags Flags
+		n     int
+	}{
+		{"a.b", Flags{}, 2},
+		{"c.d.e", Flags{}, 3},
+		{"c.f", Flags{}, 0},
+		{"C.D.E", Flags{CaseInsensitiveKeys: true}, 3},
+		{"g", Flags{AllowDuplicateKeys: true}, 4},
+	}
+	for _, test := range tests {
+		n, err := CountElements("none", content, test.key, test.flags)
+		if err != nil {
+			t.Fatalf("%s: %v", test.key, err)
+		}
+		if n != test.n {
+			t.Errorf("%s: want %d, have %d", test.key, test.n, n)
+		}
+	}
+
+	for _, key := range []string{"C.D.E", "c.d.x", "a"} {
+		if _, err := CountElements("none", content, key, Flags{AllowDuplicateKeys: true}); err == nil {
+			t.Errorf("%s: expected error", key)
+		}
+	}
+}
+
+func TestMatchKeys(t *testing.T) {
+	root, err := Parse("none", "feature_b = true;\nname = \"x\";\nfeature_a = false;\n", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have := root.MatchKeys("feature_*")
+	if !slices.Equal(have, []string{"feature_b", "feature_a"}) {
+		t.Fatal("unexpected keys:", have)
+	}
+	if have := root.MatchKeys("missing*"); have != nil {
+		t.Fatal("unexpected keys:", have)
+	}
+	if have := root.MatchKeys("["); have != nil {
+		t.Fatal("unexpected keys:", have)
+	}
+}
+
+func TestUnmarshalSignedList(t *testing.T) {
+	root, err := Parse("none", "a = [ -1; -2; +3; ];\nb = [ -1; ];\nc = [ 300; ];\n", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s struct {
+		A []int `kevs:"a"`
+	}
+	if err := root.Unmarshal(&s); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(s.A, []int{-1, -2, 3}) {
+		t.Fatal("unexpected values:", s.A)
+	}
+
+	var u struct {
+		B []uint `kevs:"b"`
+	}
+	err = root.Unmarshal(&u)
+	if err == nil || err.Error() != "element 0: negative value -1 into unsigned" {
+		t.Fatal("unexpected error:", err)
+	}
+
+	var o struct {
+		C []int8 `kevs:"c"`
+	}
+	err = root.Unmarshal(&o)
+	if err == nil || err.Error() != "element 0: value 300 overflows int8" {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestGet(t *testing.T) {
+	root, err := Parse("none", "a = 1;\nb = \"x\";\n", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, ok := root.Get("b")
+	if !ok || v.Kind != ValueKindString || v.Data.String != "x" {
+		t.Fatal("fail:", v, ok)
+	}
+	v, ok = root.Get("c")
+	if ok || v.Kind != ValueKindUndefined {
+		t.Fatal("fail:", v, ok)
+	}
+
+	allocs := testing.AllocsPerRun(10, func() {
+		root.Get("c")
+	})
+	if allocs != 0 {
+		t.Fatal("unexpected allocations:", allocs)
+	}
+}
+
+func TestParseDiagnostics(t *testing.T) {
+	root, diags := ParseDiagnostics("none", "a = 1;\n", Flags{})
+	if diags != nil || len(root) != 1 {
+		t.Fatal("fail:", root, diags)
+	}
+
+	_, diags = ParseDiagnostics("cfg.kevs", "a = 1;\nb = x;\n", Flags{})
+	if len(diags) != 1 {
+		t.Fatal("unexpected diagnostics:", diags)
+	}
+	data, err := json.Marshal(diags[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"file":"cfg.kevs","line":2,"column":5,"severity":"error","message":"value 'x' is not an integer: invalid digit, bigger than base"}`
+	if string(data) != want {
+		t.Fatalf("want %s, have %s", want, data)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	root, err := Parse("none", `
+s = "x";
+i = 1;
+b = true;
+t = { a = 1; };
+l = [ 1; ];
+`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := root.Index()
+
+	if v, err := index.GetString("s"); err != nil || v != "x" {
+		t.Fatal("s:", v, err)
+	}
+	if v, err := index.GetInteger("i"); err != nil || v != 1 {
+		t.Fatal("i:", v, err)
+	}
+	if v, err := index.GetBoolean("b"); err != nil || v != true {
+		t.Fatal("b:", v, err)
+	}
+	if v, err := index.GetTable("t"); err != nil || len(v) != 1 {
+		t.Fatal("t:", v, err)
+	}
+	if v, err := index.GetList("l"); err != nil || len(v) != 1 {
+		t.Fatal("l:", v, err)
+	}
+	if _, err := index.GetString("i"); err == nil {
+		t.Fatal("expected kind error")
+	}
+	if _, err := index.GetString("missing"); err == nil {
+		t.Fatal("expected missing key error")
+	}
+}
+
+func TestColumns(t *testing.T) {
+	tokens, err := Scan("none", "a = 1;  bb\t= [ \"x\"; ];\n  c = `\nr`; d = 2;\n", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type pos struct {
+		value        string
+		line, column int
+	}
+	want := []pos{
+		{"a", 1, 1}, {"=", 1, 3}, {"1", 1, 5}, {";", 1, 6},
+		{"bb", 1, 9}, {"=", 1, 12}, {"[", 1, 14}, {`"x"`, 1, 16}, {";", 1, 19}, {"]", 1, 21}, {";", 1, 22},
+		{"c", 2, 3}, {"=", 2, 5}, {"`\nr`", 2, 7}, {";", 3, 3}, {"d", 3, 5}, {"=", 3, 7}, {"2", 3, 9}, {";", 3, 10},
+	}
+	if len(tokens) != len(want) {
+		t.Fatalf("want %d tokens, have %d", len(want), len(tokens))
+	}
+	for i, tok := range tokens {
+		have := pos{tok.Value, tok.Line, tok.Column}
+		if have != want[i] {
+			t.Errorf("want %v, have %v", want[i], have)
+		}
+	}
+
+	_, err = Parse("none", "a = 1;\n  b = 1 2;\n", Flags{})
+	if err == nil || !strings.HasPrefix(err.Error(), "none:2:7: error: parse:") {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestCollectAll(t *testing.T) {
+	content := `a = 1;
+b 2;
+c = x;
+d = [ 1; 2; ];
+e = "unterminated;
+f = { g = 1; g = 2; };
+h = true;
+`
+
+	root, err := Parse("none", content, Flags{CollectAll: true})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	var lines []int
+	for _, err := range flatten_errors(err) {
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Fatal("unexpected error type:", err)
+		}
+		lines = append(lines, e.Line)
+	}
+	if !slices.Equal(lines, []int{2, 5, 3, 6}) {
+		t.Fatal("unexpected error lines:", lines, err)
+	}
+
+	var keys []string
+	for k := range root.All() {
+		keys = append(keys, k)
+	}
+	if !slices.Equal(keys, []string{"a", "d", "h"}) {
+		t.Fatal("unexpected keys:", keys)
+	}
+
+	_, diags := ParseDiagnostics("none", content, Flags{CollectAll: true})
+	if len(diags) != 4 {
+		t.Fatal("unexpected diagnostics:", diags)
+	}
+
+	if _, err := Parse("none", content, Flags{CollectAll: true, AbortOnError: true}); err == nil {
+		t.Fatal("expected error for conflicting flags")
+	}
+}
+
+func TestUnmarshalPointers(t *testing.T) {
+	type data struct {
+		String  *string `kevs:"string"`
+		Integer *int    `kevs:"integer"`
+		Boolean *bool   `kevs:"boolean"`
+		Struct  *struct {
+			X int `kevs:"x"`
+		} `kevs:"struct"`
+	}
+
+	root, err := Parse("none", "integer = 42;\nstruct = { x = 1; };\n", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := "stale"
+	d := data{String: &s}
+	if err := root.Unmarshal(&d); err != nil {
+		t.Fatal(err)
+	}
+	if d.String != nil || d.Boolean != nil {
+		t.Fatal("absent keys must leave nil pointers")
+	}
+	if d.Integer == nil || *d.Integer != 42 {
+		t.Fatal("fail:", d.Integer)
+	}
+	if d.Struct == nil || d.Struct.X != 1 {
+		t.Fatal("fail:", d.Struct)
+	}
+
+	out, err := MarshalStruct(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "integer = 42;\nstruct = {\n    x = 1;\n};\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	root, err = Parse("none", "integer = \"x\";\n", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Unmarshal(&d); err == nil {
+		t.Fatal("expected kind error")
+	}
+}
+
+func TestDuration(t *testing.T) {
+	root, err := Parse("none", "a = \"1m30s\";\nb = 1000;\nc = \"soon\";\nd = true;\n", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := root.GetDuration("a"); err != nil || v != 90*time.Second {
+		t.Fatal("a:", v, err)
+	}
+	if v, err := root.GetDuration("b"); err != nil || v != time.Microsecond {
+		t.Fatal("b:", v, err)
+	}
+	if _, err := root.GetDuration("c"); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := root.GetDuration("d"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	var d struct {
+		A time.Duration  `kevs:"a"`
+		B *time.Duration `kevs:"b"`
+	}
+	if err := root.Unmarshal(&d); err != nil {
+		t.Fatal(err)
+	}
+	if d.A != 90*time.Second || d.B == nil || *d.B != time.Microsecond {
+		t.Fatal("fail:", d)
+	}
+
+	var bad struct {
+		C time.Duration `kevs:"c"`
+	}
+	err = root.Unmarshal(&bad)
+	if err == nil || !strings.HasPrefix(err.Error(), "struct '': field 'C': time: invalid duration") {
+		t.Fatal("unexpected error:", err)
+	}
+
+	out, err := MarshalStruct(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "a = \"1m30s\";\nb = \"1µs\";\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestTime(t *testing.T) {
+	root, err := Parse("none", "a = \"2024-01-02T15:04:05Z\";\nb = \"2024-01-02\";\nc = 1;\n", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	if v, err := root.GetTime("a"); err != nil || !v.Equal(want) {
+		t.Fatal("a:", v, err)
+	}
+	if _, err := root.GetTime("b"); err == nil || err.Error() != "key 'b': value '2024-01-02' is not an RFC 3339 time" {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := root.GetTime("c"); err == nil || err.Error() != "key 'c': value is integer, expected string" {
+		t.Fatal("unexpected error:", err)
+	}
+
+	var d struct {
+		Start time.Time `kevs:"a"`
+	}
+	if err := root.Unmarshal(&d); err != nil {
+		t.Fatal(err)
+	}
+	if !d.Start.Equal(want) {
+		t.Fatal("fail:", d.Start)
+	}
+
+	out, err := MarshalStruct(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "a = \"2024-01-02T15:04:05Z\";\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestUnmarshalListOfLists(t *testing.T) {
+	root, err := Parse("none", "ints = [ [ 1; 2; ]; []; [ 3; ]; ];\nstrs = [ [ \"a\"; ]; [ \"b\"; \"c\"; ]; ];\n", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d struct {
+		Ints [][]int    `kevs:"ints"`
+		Strs [][]string `kevs:"strs"`
+	}
+	if err := root.Unmarshal(&d); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(d.Ints) != 3 || !slices.Equal(d.Ints[0], []int{1, 2}) || len(d.Ints[1]) != 0 || !slices.Equal(d.Ints[2], []int{3}) {
+		t.Fatal("unexpected ints:", d.Ints)
+	}
+	if len(d.Strs) != 2 || !slices.Equal(d.Strs[0], []string{"a"}) || !slices.Equal(d.Strs[1], []string{"b", "c"}) {
+		t.Fatal("unexpected strs:", d.Strs)
+	}
+}
+
+func TestUnmarshalListOfStructs(t *testing.T) {
+	type server struct {
+		Host string `kevs:"host"`
+		Port int    `kevs:"port"`
+		TLS  struct {
+			Enabled bool `kevs:"enabled"`
+		} `kevs:"tls"`
+	}
+
+	content := `
+servers = [
+    { host = "a"; port = 1; tls = { enabled = true; }; };
+    { host = "b"; port = 2; tls = { enabled = false; }; };
+];
+`
+
+	root, err := Parse("none", content, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d struct {
+		Servers []server `kevs:"servers"`
+	}
+	if err := root.Unmarshal(&d); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(d.Servers) != 2 {
+		t.Fatal("fail:", d.Servers)
+	}
+	if d.Servers[0].Host != "a" || d.Servers[0].Port != 1 || !d.Servers[0].TLS.Enabled {
+		t.Fatal("fail:", d.Servers[0])
+	}
+	if d.Servers[1].Host != "b" || d.Servers[1].Port != 2 || d.Servers[1].TLS.Enabled {
+		t.Fatal("fail:", d.Servers[1])
+	}
+
+	root, err = Parse("none", `servers = [ { host = "a"; }; ];`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = root.Unmarshal(&d)
+	if err == nil || err.Error() != "element 0: struct 'server': field 'Port': key not found" {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestUnmarshalMixedList(t *testing.T) {
+	root, err := Parse("none", "a = [ \"a\"; 42; ];\nb = [ 1; [ 2; ]; ];\n", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var a struct {
+		A []string `kevs:"a"`
+	}
+	err = root.Unmarshal(&a)
+	if err == nil || err.Error() != "element 1: expected string, got integer" {
+		t.Fatal("unexpected error:", err)
+	}
+
+	var b struct {
+		B []int `kevs:"b"`
+	}
+	err = root.Unmarshal(&b)
+	if err == nil || err.Error() != "element 1: expected integer, got list" {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestDumpTo(t *testing.T) {
+	root, err := Parse("none", "a = 1;\nb = [ \"x\"; true; ];\nc = { d = 2; };\n", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	root.DumpTo(&buf)
+
+	want := `a integer 1
+b list
+string 'x'
+boolean true
+c table
+d integer 2
+`
+	if buf.String() != want {
+		t.Fatalf("want %q, have %q", want, buf.String())
+	}
+}
+
+func Test_str_to_int(t *testing.T) {
+	valid := []struct {
+		in  string
+		out int64
+	}{
+		{"1_000_000", 1000000},
+		{"0xdead_beef", 0xdeadbeef},
+		{"0b1010_1010", 0xaa},
+		{"0o7_7", 077},
+		{"-1_0", -10},
+	}
+	for _, test := range valid {
+		out, err := str_to_int(test.in, 0)
+		if err != nil {
+			t.Errorf("%s: %v", test.in, err)
+			continue
+		}
+		if out != test.out {
+			t.Errorf("%s: want %d, have %d", test.in, test.out, out)
+		}
+	}
+
+	invalid := []string{"1__0", "_5", "5_", "0x_ff", "0_1", "-_1", "_"}
+	for _, in := range invalid {
+		if _, err := str_to_int(in, 0); err == nil {
+			t.Errorf("%s: expected error", in)
+		}
+	}
+
+	root, err := Parse("none", "max_bytes = 1_000_000;", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := root.GetInteger("max_bytes"); err != nil || n != 1000000 {
+		t.Fatalf("unexpected result: %d, %v", n, err)
+	}
+
+	// separators are for integer literals only, not escape digits
+	for _, in := range []string{`s = "\u0_41";`, `s = "\U0000_041";`} {
+		if _, err := Parse("none", in, Flags{}); err == nil {
+			t.Errorf("%s: expected error", in)
+		}
+	}
+}
+
+func TestSignedIntegers(t *testing.T) {
+	root, err := Parse("none", `
+a = -0o17;
+b = +0b1010;
+c = -0x10;
+d = -0x8000000000000000;
+e = 0x7fffffffffffffff;
+f = -9223372036854775808;
+g = +0;
+`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []int64{-15, 10, -16, math.MinInt64, math.MaxInt64, math.MinInt64, 0}
+	for i, kv := range root {
+		if kv.Value.Kind != ValueKindInteger {
+			t.Fatalf("%s: expected integer, got %s", kv.Key, kv.Value.Kind)
+		}
+		if kv.Value.Data.Integer != want[i] {
+			t.Errorf("%s: want %d, have %d", kv.Key, want[i], kv.Value.Data.Integer)
+		}
+	}
+
+	invalid := []string{
+		"-0x8000000000000001",
+		"0x10000000000000000",
+		"-+1",
+		"+-0x1",
+		"-",
+		"+",
+		"-0x",
+		"0x-1",
+	}
+	for _, in := range invalid {
+		if _, err := Parse("none", "a = "+in+";", Flags{}); err == nil {
+			t.Errorf("%s: expected error", in)
+		}
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	dir := t.TempDir()
+
+	good := filepath.Join(dir, "good.kevs")
+	if err := os.WriteFile(good, []byte("a = 1;\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	root, err := ParseFile(good, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := root.GetInteger("a"); err != nil || n != 1 {
+		t.Fatalf("unexpected result: %d, %v", n, err)
+	}
+
+	bad := filepath.Join(dir, "bad.kevs")
+	if err := os.WriteFile(bad, []byte("a = 1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseFile(bad, Flags{})
+	if err == nil || !strings.HasPrefix(err.Error(), bad+":") {
+		t.Fatalf("expected error with file name, got %v", err)
+	}
+
+	_, err = ParseFile(filepath.Join(dir, "missing.kevs"), Flags{})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+}
+
+func TestGetPath(t *testing.T) {
+	root, err := Parse("none", `
+server = { tls = { port = 443; }; };
+servers = [ { host = "a"; }; { host = "b"; }; ];
+name = "x";
+`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := root.GetPath("server.tls.port")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Kind != ValueKindInteger || v.Data.Integer != 443 {
+		t.Fatalf("unexpected value: %v", v)
+	}
+
+	v, err = root.GetPath("servers.1.host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Kind != ValueKindString || v.Data.String != "b" {
+		t.Fatalf("unexpected value: %v", v)
+	}
+
+	tests := []struct {
+		path string
+		err  string
+	}{
+		{"", "empty path"},
+		{"server.tls.host", "path 'server.tls.host': key not found"},
+		{"servers.2.host", "path 'servers.2': index 2 out of range, list has 2 elements"},
+		{"servers.x", "path 'servers.x': 'x' is not a list index"},
+		{"name.first", "path 'name': value is string, expected table"},
+		{"name.0", "path 'name': value is string, expected list"},
+	}
+	for _, test := range tests {
+		_, err := root.GetPath(test.path)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: want error %q, have %v", test.path, test.err, err)
+		}
+	}
+
+	if _, err := root.GetPath("name.first"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("want ErrWrongType, have %v", err)
+	}
+}
+
+func TestGetDefault(t *testing.T) {
+	root, err := Parse("none", `s = "x"; i = 1; b = true;`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := root.GetStringDefault("s", "d"); v != "x" {
+		t.Errorf("want x, have %s", v)
+	}
+	if v := root.GetStringDefault("i", "d"); v != "d" {
+		t.Errorf("want d, have %s", v)
+	}
+	if v := root.GetStringDefault("missing", "d"); v != "d" {
+		t.Errorf("want d, have %s", v)
+	}
+
+	if v := root.GetIntegerDefault("i", 2); v != 1 {
+		t.Errorf("want 1, have %d", v)
+	}
+	if v := root.GetIntegerDefault("s", 2); v != 2 {
+		t.Errorf("want 2, have %d", v)
+	}
+	if v := root.GetIntegerDefault("missing", 2); v != 2 {
+		t.Errorf("want 2, have %d", v)
+	}
+
+	if v := root.GetBooleanDefault("b", false); v != true {
+		t.Errorf("want true, have %v", v)
+	}
+	if v := root.GetBooleanDefault("s", true); v != true {
+		t.Errorf("want true, have %v", v)
+	}
+	if v := root.GetBooleanDefault("missing", true); v != true {
+		t.Errorf("want true, have %v", v)
+	}
+}
+
+func TestCommentAtEOF(t *testing.T) {
+	for _, content := range []string{
+		"# only a comment",
+		"a = 1;\n# last line comment",
+		"a = 1; # trailing comment",
+	} {
+		root, stats, err := ParseWithStats("none", content, Flags{})
+		if err != nil {
+			t.Fatalf("%q: %v", content, err)
+		}
+		if stats.CommentCount != 1 {
+			t.Errorf("%q: want 1 comment, have %d", content, stats.CommentCount)
+		}
+		if len(root) > 0 {
+			if n, err := root.GetInteger("a"); err != nil || n != 1 {
+				t.Errorf("%q: unexpected result: %d, %v", content, n, err)
+			}
+		}
+	}
+
+	if _, err := Parse("none", "a = [ 1; # comment", Flags{}); err == nil {
+		t.Fatal("expected error for unterminated list")
+	}
+}
+
+func TestKeepComments(t *testing.T) {
+	content := `# server settings
+# more
+server = {
+    # listen port
+    port = 80;
+    hosts = [
+        # first host
+        "a";
+    ];
+};
+name = "x";
+# trailing
+`
+	flags := Flags{KeepComments: true}
+
+	tokens, err := Scan("none", content, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens[0].Kind != TokenKindComment || tokens[0].Value != "# server settings" || tokens[0].Line != 1 {
+		t.Fatalf("unexpected first token: %+v", tokens[0])
+	}
+
+	root, err := Parse("none", content, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(root[0].Comments, []string{"# server settings", "# more"}) {
+		t.Fatalf("unexpected comments: %q", root[0].Comments)
+	}
+	port := root[0].Value.Data.Table[0]
+	if !slices.Equal(port.Comments, []string{"# listen port"}) {
+		t.Fatalf("unexpected comments: %q", port.Comments)
+	}
+	if root[1].Comments != nil {
+		t.Fatalf("unexpected comments: %q", root[1].Comments)
+	}
+
+	out, err := Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != content {
+		t.Log("want:", content)
+		t.Log("have:", string(out))
+		t.Fatal("unexpected output")
+	}
+
+	v, err := ParseSection("none", content, "name", flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Data.String != "x" {
+		t.Fatalf("unexpected value: %v", v)
+	}
+
+	root, err = Parse("none", content, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root[0].Comments != nil {
+		t.Fatal("comments kept without KeepComments")
+	}
+}
+
+func TestCommentsRoundTrip(t *testing.T) {
+	content := `# about the file
+a = 1; # about a
+b = 2;
+list = [
+    # before 1
+    1; # about 1
+    [
+        2; # about 2
+        # end of the inner list
+    ]; # about the inner list
+    # end of list
+]; # about list
+table = {
+    x = true; # about x
+    # end of table
+}; # about table
+# end of file
+# really
+`
+	root, err := Parse("none", content, Flags{KeepComments: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv := root[0]; kv.Comment != "# about a" || !slices.Equal(kv.Comments, []string{"# about the file"}) {
+		t.Fatalf("unexpected comments of a: %+v", kv)
+	}
+	if kv := root[1]; kv.Comment != "" || kv.Comments != nil {
+		t.Fatalf("unexpected comments of b: %+v", kv)
+	}
+	if v := root[2].Value.Data.List[0]; v.Comment != "# about 1" || !slices.Equal(v.Comments, []string{"# before 1"}) {
+		t.Fatalf("unexpected comments of 1: %+v", v)
+	}
+	if kv := root[len(root)-1]; !slices.Equal(kv.Trailing, []string{"# end of file", "# really"}) {
+		t.Fatalf("unexpected trailing comments: %q", kv.Trailing)
+	}
+
+	out, err := Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != content {
+		t.Log("want:", content)
+		t.Log("have:", string(out))
+		t.Fatal("unexpected output")
+	}
+
+	// comments are not values
+	if !root.Equal(mustParse(t, content)) {
+		t.Fatal("comments changed the table")
+	}
+}
+
+func TestTrailingComments(t *testing.T) {
+	content := `port = 8080; # the listen port
+debug = true;# no space
+list = [
+    1; # first
+    2; # second
+]; # end of list
+table = {
+    a = 1; # inner
+    b = [ 1; ]; # inner list
+}; # end of table
+`
+	root, stats, err := ParseWithStats("none", content, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.CommentCount != 8 {
+		t.Errorf("want 8 comments, have %d", stats.CommentCount)
+	}
+
+	want := `port = 8080;
+debug = true;
+list = [
+    1;
+    2;
+];
+table = {
+    a = 1;
+    b = [
+        1;
+    ];
+};
+`
+	out, err := Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != want {
+		t.Log("want:", want)
+		t.Log("have:", string(out))
+		t.Fatal("unexpected output")
+	}
+}
+
+func TestAllowDuplicateKeys(t *testing.T) {
+	content := `
+a = 1;
+b = { x = 1; y = 2; x = 3; };
+c = true;
+a = "two";
+`
+	if _, err := Parse("none", content, Flags{}); err == nil {
+		t.Fatal("expected error for duplicate keys")
+	}
+
+	root, err := Parse("none", content, Flags{AllowDuplicateKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(root) != 3 || root[0].Key != "a" {
+		t.Fatalf("override not in place: %v", root)
+	}
+	if s, err := root.GetString("a"); err != nil || s != "two" {
+		t.Fatalf("unexpected result: %s, %v", s, err)
+	}
+
+	b, err := root.GetTable("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 2 || b[0].Key != "x" || b[0].Value.Data.Integer != 3 {
+		t.Fatalf("unexpected table: %v", b)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	defaults, err := Parse("none", `
+name = "app";
+server = { host = "localhost"; port = 80; tls = { enabled = false; cert = "a.pem"; }; };
+tags = [ "a"; "b"; ];
+`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	overrides, err := Parse("none", `
+server = { port = 443; tls = { enabled = true; }; };
+tags = [ "c"; ];
+debug = true;
+`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Parse("none", `
+name = "app";
+server = { host = "localhost"; port = 443; tls = { enabled = true; cert = "a.pem"; }; };
+tags = [ "c"; ];
+debug = true;
+`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := tableString(t, defaults)
+
+	merged := defaults.Merge(overrides)
+	if tableString(t, merged) != tableString(t, want) {
+		t.Log("want:", tableString(t, want))
+		t.Log("have:", tableString(t, merged))
+		t.Fatal("unexpected merge result")
+	}
+
+	if tableString(t, defaults) != before {
+		t.Fatal("merge modified self")
+	}
+	merged[1].Value.Data.Table[0].Value.Data.String = "changed"
+	if tableString(t, defaults) != before {
+		t.Fatal("merge result shares memory with self")
+	}
+}
+
+func tableString(t *testing.T, table Table) string {
+	t.Helper()
+	out, err := Marshal(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestClone(t *testing.T) {
+	root, err := Parse("none", `a = { b = [ 1; { c = "x"; }; ]; };`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := tableString(t, root)
+
+	c := root.Clone()
+	c[0].Value.Data.Table[0].Value.Data.List[0].Data.Integer = 2
+	c[0].Value.Data.Table[0].Value.Data.List[1].Data.Table[0].Value.Data.String = "y"
+	c[0].Key = "z"
+	if tableString(t, root) != before {
+		t.Fatal("clone shares memory with the original")
+	}
+
+	l := root[0].Value.Data.Table[0].Value.Data.List
+	lc := l.Clone()
+	lc[1].Data.Table[0].Key = "d"
+	if l[1].Data.Table[0].Key != "c" {
+		t.Fatal("list clone shares memory with the original")
+	}
+
+	if Table(nil).Clone() != nil || List(nil).Clone() != nil {
+		t.Fatal("clone of nil is not nil")
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("KEVS_TEST_PASSWORD", "secret")
+	t.Setenv("KEVS_TEST_EMPTY", "")
+
+	root, err := Parse("none", `
+password = "${KEVS_TEST_PASSWORD}";
+dsn = "user:${KEVS_TEST_PASSWORD}@${KEVS_TEST_HOST:-localhost}";
+empty = "${KEVS_TEST_EMPTY:-default}";
+raw = `+"`${KEVS_TEST_PASSWORD}`"+`;
+dollar = "$5 and $HOME";
+`, Flags{ExpandEnv: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"password": "secret",
+		"dsn":      "user:secret@localhost",
+		"empty":    "default",
+		"raw":      "${KEVS_TEST_PASSWORD}",
+		"dollar":   "$5 and $HOME",
+	}
+	for key, w := range want {
+		if have, _ := root.GetString(key); have != w {
+			t.Errorf("%s: want %q, have %q", key, w, have)
+		}
+	}
+
+	for _, content := range []string{
+		`a = "${KEVS_TEST_UNSET}";`,
+		`a = "${KEVS_TEST_PASSWORD";`,
+		`a = "${}";`,
+	} {
+		if _, err := Parse("none", content, Flags{ExpandEnv: true}); err == nil {
+			t.Errorf("%s: expected error", content)
+		}
+	}
+
+	root, err = Parse("none", `a = "${KEVS_TEST_UNSET}";`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := root.GetString("a"); s != "${KEVS_TEST_UNSET}" {
+		t.Fatalf("expanded without ExpandEnv: %s", s)
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	content := `---
+a = 1;
+---
+b = 2;
+c = 3;
+   ---  
+---
+d = "---";
+`
+	docs, err := ParseAll("none", content, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 4 {
+		t.Fatalf("want 4 documents, have %d", len(docs))
+	}
+	want := []int{1, 2, 0, 1}
+	for i, doc := range docs {
+		if len(doc) != want[i] {
+			t.Errorf("document %d: want %d keys, have %d", i, want[i], len(doc))
+		}
+	}
+	if s, _ := docs[3].GetString("d"); s != "---" {
+		t.Fatalf("unexpected value: %s", s)
+	}
+
+	_, err = ParseAll("none", "a = 1;\n---\nb = 2;\n---\nc = 3\n", Flags{})
+	if err == nil || !strings.HasPrefix(err.Error(), "none:5:") {
+		t.Fatalf("expected error at line 5, got %v", err)
+	}
+
+	docs, err = ParseAll("none", "a = 1;\n---\nb = x;\n---\nc = y;\n", Flags{CollectAll: true})
+	if len(docs) != 3 || len(docs[0]) != 1 {
+		t.Fatalf("unexpected documents: %v", docs)
+	}
+	var all []string
+	for _, e := range flatten_errors(err) {
+		all = append(all, e.Error())
+	}
+	if len(all) != 2 || !strings.HasPrefix(all[0], "none:3:") || !strings.HasPrefix(all[1], "none:5:") {
+		t.Fatalf("unexpected errors: %q", all)
+	}
+
+	docs, err = ParseAll("none", "", Flags{})
+	if err != nil || len(docs) != 1 {
+		t.Fatalf("unexpected result: %v, %v", docs, err)
+	}
+}
+
+func TestParseAllNewlines(t *testing.T) {
+	for _, eol := range []string{"\n", "\r\n", "\r"} {
+		content := strings.ReplaceAll("a = 1;\n---\nb = 2;\nc = 3\n", "\n", eol)
+		_, err := ParseAll("none", content, Flags{})
+		if err == nil || !strings.HasPrefix(err.Error(), "none:4:") {
+			t.Fatalf("%q: expected error at line 4, got %v", eol, err)
+		}
+
+		content = strings.ReplaceAll("a = 1;\n---\nb = \"x\ry\";\n", "\n", eol)
+		docs, err := ParseAll("none", content, Flags{})
+		if err != nil {
+			t.Fatalf("%q: %v", eol, err)
+		}
+		if len(docs) != 2 || len(docs[0]) != 1 || len(docs[1]) != 1 {
+			t.Fatalf("%q: unexpected documents: %v", eol, docs)
+		}
+		if s, _ := docs[1].GetString("b"); s != "x\ry" {
+			t.Fatalf("%q: unexpected value: %q", eol, s)
+		}
+	}
+}
+
+func TestParseAllLimits(t *testing.T) {
+	content := strings.Repeat("a = 1;\n---\n", 1000)
+
+	_, err := ParseAll("none", content, Flags{MaxInputSize: 20})
+	if err == nil || err.Error() != "none: error: scan: input size 11000 exceeds maximum of 20" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := ParseAll("none", content, Flags{MaxInputSize: len(content)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 4 tokens per document
+	if _, err := ParseAll("none", content, Flags{MaxTokens: 4000}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseAll("none", content, Flags{MaxTokens: 3999})
+	if err == nil || !strings.HasSuffix(err.Error(), "maximum number of tokens exceeded") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTokenScanner(t *testing.T) {
+	content := `
+a = 1;
+b = [ "x"; { c = true; }; ];
+# comment
+d = { e = 2; };
+`
+	want, err := Scan("none", content, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var have []Token
+	ts := NewScanner("none", content, Flags{})
+	for tok, ok := ts.Next(); ok; tok, ok = ts.Next() {
+		have = append(have, tok)
+	}
+	if err := ts.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(have, want) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+
+	ts = NewScanner("none", "a = 1;\nb = 2\n", Flags{})
+	n := 0
+	for _, ok := ts.Next(); ok; _, ok = ts.Next() {
+		n++
+	}
+	if n != 4 {
+		t.Fatalf("want the 4 tokens before the error, have %d", n)
+	}
+	if ts.Err() == nil {
+		t.Fatal("expected error")
+	}
+	if _, ok := ts.Next(); ok {
+		t.Fatal("token after error")
+	}
+
+	ts = NewScanner("none", "a = 1;\nb = 2\nc = 3;\n", Flags{CollectAll: true})
+	var keys []string
+	for tok, ok := ts.Next(); ok; tok, ok = ts.Next() {
+		if tok.Kind == TokenKindKey {
+			keys = append(keys, tok.Value)
+		}
+	}
+	if !slices.Equal(keys, []string{"a", "c"}) {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if ts.Err() == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestParseTokensFound(t *testing.T) {
+	key := Token{Kind: TokenKindKey, Value: "a", Line: 1, Column: 1}
+	sep := Token{Kind: TokenKindDelim, Value: "=", Line: 1, Column: 3}
+	end := Token{Kind: TokenKindDelim, Value: ";", Line: 1, Column: 5}
+	val := Token{Kind: TokenKindValue, Value: "1", Line: 1, Column: 5}
+
+	tests := []struct {
+		tokens []Token
+		err    string
+	}{
+		{[]Token{key, sep, end}, "expected value token, found delim ';'"},
+		{[]Token{val}, "expected key token, found value '1'"},
+		{[]Token{key, val}, "missing key value separator, found value '1'"},
+		{[]Token{key, sep, val, val}, "missing key value end, found value '1'"},
+		{[]Token{key, sep, {Kind: TokenKindValue, Line: 1, Column: 5}, end}, "missing value"},
+	}
+	for _, test := range tests {
+		_, err := ParseTokens("none", "", Flags{}, test.tokens)
+		if err == nil || !strings.HasSuffix(err.Error(), "parse: "+test.err) {
+			t.Errorf("want error %q, have %v", test.err, err)
+		}
+	}
+
+	if _, err := Parse("none", "a = ;", Flags{}); err == nil || !strings.HasSuffix(err.Error(), "missing value") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestUnmarshalIntegerWidth(t *testing.T) {
+	type data struct {
+		Small int8   `kevs:"small"`
+		Port  uint16 `kevs:"port"`
+		Big   int64  `kevs:"big"`
+		Size  uint   `kevs:"size"`
+	}
+
+	root, err := Parse("none", `small = -128; port = 65535; big = 0x7fffffffffffffff; size = 42;`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d data
+	if err := root.Unmarshal(&d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Small != -128 || d.Port != 65535 || d.Big != math.MaxInt64 || d.Size != 42 {
+		t.Fatalf("unexpected result: %+v", d)
+	}
+
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{`small = 128; port = 1; big = 1; size = 1;`, "struct 'data': field 'Small': value 128 overflows int8"},
+		{`small = -129; port = 1; big = 1; size = 1;`, "struct 'data': field 'Small': value -129 overflows int8"},
+		{`small = 1; port = 65536; big = 1; size = 1;`, "struct 'data': field 'Port': value 65536 overflows uint16"},
+		{`small = 1; port = 1; big = 1; size = -1;`, "struct 'data': field 'Size': negative value -1 into unsigned"},
+	}
+	for _, test := range tests {
+		root, err := Parse("none", test.content, Flags{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = root.Unmarshal(&d)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("want error %q, have %v", test.err, err)
+		}
+	}
+}
+
+func TestGetUint(t *testing.T) {
+	root, err := Parse("none", `
+max = 18446744073709551615;
+big = 0x8000000000000000;
+small = 42;
+negative = -1;
+`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key string
+		n   uint64
+	}{
+		{"max", math.MaxUint64},
+		{"big", math.MaxInt64 + 1},
+		{"small", 42},
+	}
+	for _, test := range tests {
+		n, err := root.GetUint(test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != test.n {
+			t.Errorf("%s: want %d, have %d", test.key, test.n, n)
+		}
+	}
+
+	if _, err := root.GetUint("negative"); err == nil {
+		t.Fatal("expected error for negative value")
+	}
+	if _, err := root.GetInteger("max"); err == nil {
+		t.Fatal("expected error for value above int64")
+	}
+	if _, err := root.Index().GetUint("max"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	root.DumpTo(&buf)
+	if !strings.Contains(buf.String(), "max integer 18446744073709551615\n") {
+		t.Fatalf("unexpected dump: %q", buf.String())
+	}
+
+	type data struct {
+		Max   uint64   `kevs:"max"`
+		Small uint8    `kevs:"small"`
+		List  []uint64 `kevs:"list"`
+	}
+	root, err = Parse("none", `max = 18446744073709551615; small = 42; list = [ 0xffffffffffffffff; 1; ];`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d data
+	if err := root.Unmarshal(&d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Max != math.MaxUint64 || d.Small != 42 || !slices.Equal(d.List, []uint64{math.MaxUint64, 1}) {
+		t.Fatalf("unexpected result: %+v", d)
+	}
+
+	out, err := MarshalStruct(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "max = 18446744073709551615;\nsmall = 42;\nlist = [\n    18446744073709551615;\n    1;\n];\n"
+	if string(out) != want {
+		t.Fatalf("want %q, have %q", want, out)
+	}
+
+	for _, in := range []string{"18446744073709551616", "-9223372036854775809"} {
+		if _, err := Parse("none", "a = "+in+";", Flags{}); err == nil {
+			t.Errorf("%s: expected error", in)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	root, err := Parse("none", `
+a = 1;
+b = { c = "x"; d = [ true; { e = 2; }; ]; };
+`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var have []string
+	err = root.Walk(func(path []string, v Value) error {
+		have = append(have, strings.Join(path, ".")+" "+v.Kind.String())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"a integer",
+		"b table",
+		"b.c string",
+		"b.d list",
+		"b.d.0 boolean",
+		"b.d.1 table",
+		"b.d.1.e integer",
+	}
+	if !slices.Equal(have, want) {
+		t.Fatalf("want %q, have %q", want, have)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = root.Walk(func(path []string, v Value) error {
+		n++
+		if v.Kind == ValueKindString {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) || n != 3 {
+		t.Fatalf("unexpected result: %d, %v", n, err)
+	}
+}
+
+func TestNull(t *testing.T) {
+	root, err := Parse("none", `proxy = null; port = null; list = [ null; 1; ]; name = "null";`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, _ := root.Get("proxy")
+	if !v.IsNull() || v.Kind.String() != "null" {
+		t.Fatalf("unexpected value: %v", v)
+	}
+	if v, _ := root.Get("name"); v.IsNull() {
+		t.Fatal("string \"null\" is null")
+	}
+	if _, err := root.GetString("proxy"); err == nil {
+		t.Fatal("expected error for null string")
+	}
+
+	out, err := Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "proxy = null;\nport = null;\nlist = [\n    null;\n    1;\n];\nname = \"null\";\n"
+	if string(out) != want {
+		t.Fatalf("want %q, have %q", want, out)
+	}
+
+	type data struct {
+		Proxy *string `kevs:"proxy"`
+		Port  int     `kevs:"port"`
+	}
+	s := "set"
+	d := data{Proxy: &s, Port: 1}
+	if err := root.Unmarshal(&d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Proxy != nil || d.Port != 0 {
+		t.Fatalf("unexpected result: %+v", d)
+	}
+
+	root, err = Parse("none", `ptrs = [ 1; null; 3; ]; ints = [ null; 2; ]; structs = [ null; { x = 1; }; ];`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lists struct {
+		Ptrs    []*int `kevs:"ptrs"`
+		Ints    []int  `kevs:"ints"`
+		Structs []*struct {
+			X int `kevs:"x"`
+		} `kevs:"structs"`
+	}
+	if err := root.Unmarshal(&lists); err != nil {
+		t.Fatal(err)
+	}
+	if len(lists.Ptrs) != 3 || *lists.Ptrs[0] != 1 || lists.Ptrs[1] != nil || *lists.Ptrs[2] != 3 {
+		t.Fatalf("unexpected ptrs: %v", lists.Ptrs)
+	}
+	if !slices.Equal(lists.Ints, []int{0, 2}) {
+		t.Fatalf("unexpected ints: %v", lists.Ints)
+	}
+	if len(lists.Structs) != 2 || lists.Structs[0] != nil || lists.Structs[1].X != 1 {
+		t.Fatalf("unexpected structs: %v", lists.Structs)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	nested := func(n int) string {
+		return "a = " + strings.Repeat("[ ", n) + "1;" + strings.Repeat(" ];", n)
+	}
+
+	if _, err := Parse("none", nested(128), Flags{}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Parse("none", nested(129), Flags{})
+	if err == nil || !strings.HasSuffix(err.Error(), "maximum nesting depth exceeded") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = Parse("none", nested(100000), Flags{})
+	if err == nil || !strings.HasSuffix(err.Error(), "maximum nesting depth exceeded") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := Parse("none", "a = { b = { c = 1; }; };", Flags{MaxDepth: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Parse("none", "a = { b = { c = {}; }; };", Flags{MaxDepth: 2}); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := Parse("none", nested(1000), Flags{MaxDepth: -1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the parser checks the depth too, for tokens scanned elsewhere
+	tokens, err := Scan("none", nested(3), Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseTokens("none", "", Flags{MaxDepth: 2}, tokens); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// the depth is restored after a failed key-value
+	root, err := Parse("none", nested(3)+"\n"+nested(2), Flags{MaxDepth: 2, CollectAll: true, AllowDuplicateKeys: true})
+	if err == nil || len(root) != 1 {
+		t.Fatalf("unexpected result: %v, %v", root, err)
+	}
+}
+
+func TestInputLimits(t *testing.T) {
+	content := "a = 1;\nb = [ 1; 2; 3; ];\n"
+
+	if _, err := Parse("none", content, Flags{MaxInputSize: len(content)}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Parse("none", content, Flags{MaxInputSize: len(content) - 1})
+	if err == nil || err.Error() != "none: error: scan: input size 25 exceeds maximum of 24" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 4 tokens for a, 11 for b
+	if _, err := Parse("none", content, Flags{MaxTokens: 15}); err != nil {
+		t.Fatal(err)
+	}
+	for _, flags := range []Flags{
+		{MaxTokens: 14},
+		{MaxTokens: 3},
+		{MaxTokens: 5, CollectAll: true},
+	} {
+		_, err := Parse("none", content, flags)
+		if err == nil || !strings.HasSuffix(err.Error(), "maximum number of tokens exceeded") {
+			t.Errorf("%+v: unexpected error: %v", flags, err)
+		}
+	}
+
+	huge := "a = [" + strings.Repeat(" 1;", 1000000) + " ];"
+	tokens, err := Scan("none", huge, Flags{MaxTokens: 100})
+	if err == nil || tokens != nil {
+		t.Fatalf("unexpected result: %d tokens, %v", len(tokens), err)
+	}
+}
+
+type embeddedBase struct {
+	Name string `kevs:"name"`
+}
+
+type EmbeddedExtra struct {
+	Debug bool `kevs:"debug"`
+}
+
+type EmbeddedServer struct {
+	Port int `kevs:"port"`
+}
+
+func TestUnmarshalEmbedded(t *testing.T) {
+	type data struct {
+		embeddedBase
+		*EmbeddedExtra
+		EmbeddedServer `kevs:"server"`
+		Count          int `kevs:"count"`
+	}
+
+	content := `
+name = "app";
+debug = true;
+server = { port = 80; };
+count = 2;
+`
+	root, err := Parse("none", content, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d data
+	if err := root.Unmarshal(&d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "app" || d.EmbeddedExtra == nil || !d.Debug || d.Port != 80 || d.Count != 2 {
+		t.Fatalf("unexpected result: %+v", d)
+	}
+
+	out, err := MarshalStruct(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "name = \"app\";\ndebug = true;\nserver = {\n    port = 80;\n};\ncount = 2;\n"
+	if string(out) != want {
+		t.Fatalf("want %q, have %q", want, out)
+	}
+
+	d.EmbeddedExtra = nil
+	out, err = MarshalStruct(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "debug") {
+		t.Fatalf("nil embedded pointer was encoded: %q", out)
+	}
+	if d.EmbeddedExtra != nil {
+		t.Fatal("marshal allocated the embedded pointer")
+	}
+
+	if err := root.Unmarshal(&struct{ embeddedBase }{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Unmarshal(&struct {
+		EmbeddedServer `kevs:"name"`
+	}{}); err == nil {
+		t.Fatal("expected error for tagged embedded struct from a string")
+	}
+}
+
+type EmbeddedShadow struct {
+	Name string `kevs:"name"`
+	Port int    `kevs:"port"`
+}
+
+func TestMarshalEmbeddedShadowed(t *testing.T) {
+	after := struct {
+		EmbeddedShadow
+		Name string `kevs:"name"`
+	}{EmbeddedShadow{Name: "inner", Port: 1}, "outer"}
+	before := struct {
+		Name string `kevs:"name"`
+		EmbeddedShadow
+	}{"outer", EmbeddedShadow{Name: "inner", Port: 1}}
+	omitted := struct {
+		EmbeddedShadow
+		Name *string `kevs:"name"`
+	}{EmbeddedShadow: EmbeddedShadow{Name: "inner", Port: 1}}
+	twice := struct {
+		EmbeddedShadow
+		embeddedBase
+	}{EmbeddedShadow{Name: "first", Port: 1}, embeddedBase{Name: "second"}}
+
+	tests := []struct {
+		in   any
+		want string
+	}{
+		{after, "port = 1;\nname = \"outer\";\n"},
+		{before, "name = \"outer\";\nport = 1;\n"},
+		{omitted, "port = 1;\n"},
+		{twice, "name = \"first\";\nport = 1;\n"},
+	}
+	for i, test := range tests {
+		out, err := MarshalStruct(test.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != test.want {
+			t.Errorf("%d: want %q, have %q", i, test.want, out)
+		}
+		if _, err := Parse("none", string(out), Flags{}); err != nil {
+			t.Errorf("%d: %v", i, err)
+		}
+	}
+}
+
+type embeddedNode struct {
+	*embeddedNode
+	X int `kevs:"x"`
+}
+
+type EmbeddedA struct {
+	*EmbeddedB
+	A int `kevs:"a"`
+}
+
+type EmbeddedB struct {
+	*EmbeddedA
+	B int `kevs:"b"`
+}
+
+func TestUnmarshalEmbeddedRecursive(t *testing.T) {
+	root, err := Parse("none", "x = 1; a = 2; b = 3;", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n embeddedNode
+	if err := root.Unmarshal(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n.X != 1 || n.embeddedNode != nil {
+		t.Fatalf("unexpected result: %+v", n)
+	}
+	if err := root.UnmarshalStrict(&struct {
+		embeddedNode
+		EmbeddedA
+	}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var a EmbeddedA
+	if err := root.Unmarshal(&a); err != nil {
+		t.Fatal(err)
+	}
+	if a.A != 2 || a.EmbeddedB == nil || a.B != 3 || a.EmbeddedB.EmbeddedA != nil {
+		t.Fatalf("unexpected result: %+v", a)
+	}
+
+	// the fields of an embedded struct of the same type are shadowed
+	n.embeddedNode = &n
+	out, err := MarshalStruct(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "x = 1;\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	// an embedded pointer is allocated only for its keys
+	d := struct {
+		*EmbeddedExtra
+		X int `kevs:"x"`
+	}{}
+	if err := root.Unmarshal(&d); err != nil {
+		t.Fatal(err)
+	}
+	if d.EmbeddedExtra != nil {
+		t.Fatal("embedded pointer allocated without its keys")
+	}
+}
+
+func TestSkipTag(t *testing.T) {
+	type data struct {
+		Name    string         `kevs:"name"`
+		Secret  string         `kevs:"-"`
+		Dash    int            `kevs:"-,"`
+		Skipped EmbeddedServer `kevs:"-"`
+	}
+
+	root, err := Parse("none", `name = "x"; Secret = "s"; - = 1;`, Flags{IdentifierFunc: func(string) bool { return true }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := data{Secret: "keep", Skipped: EmbeddedServer{Port: 1}}
+	if err := root.Unmarshal(&d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "x" || d.Secret != "keep" || d.Dash != 1 || d.Skipped.Port != 1 {
+		t.Fatalf("unexpected result: %+v", d)
+	}
+
+	// - is not an identifier, so it cannot be written back
+	_, err = MarshalStruct(d)
+	if err == nil || err.Error() != "key '-' is not a valid identifier" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTagOptions(t *testing.T) {
+	type data struct {
+		Name  string   `kevs:"name,omitempty"`
+		Port  int      `kevs:"port,omitempty"`
+		Tags  []string `kevs:"tags,omitempty"`
+		Debug bool     `kevs:"debug"`
+		Host  *string  `kevs:"host,required"`
+	}
+
+	root, err := Parse("none", `debug = false;`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d data
+	err = root.Unmarshal(&d)
+	if err == nil || err.Error() != "struct 'data': field 'Name': key not found" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	root, err = Parse("none", `name = ""; port = 0; tags = []; debug = false;`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = root.Unmarshal(&d)
+	if err == nil || err.Error() != "struct 'data': field 'Host': key not found" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	root, err = Parse("none", `name = ""; port = 0; tags = []; debug = false; host = null;`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = root.Unmarshal(&d)
+	if err == nil || err.Error() != "struct 'data': field 'Host': required value is null" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	host := "h"
+	out, err := MarshalStruct(data{Host: &host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "debug = false;\nhost = \"h\";\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	out, err = MarshalStruct(data{Name: "x", Port: 1, Tags: []string{"a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "name = \"x\";\nport = 1;\ntags = [\n    \"a\";\n];\ndebug = false;\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestCaseInsensitiveKeys(t *testing.T) {
+	root, err := Parse("none", `Port = 80; server = { HOST = "h"; };`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := root.GetFold("port"); !ok || v.Data.Integer != 80 {
+		t.Fatalf("unexpected result: %v, %v", v, ok)
+	}
+	if _, ok := root.Get("port"); ok {
+		t.Fatal("Get must match case")
+	}
+	server, _ := root.GetFold("SERVER")
+	if v, ok := server.Data.Table.GetFold("host"); !ok || v.Data.String != "h" {
+		t.Fatalf("unexpected result: %v, %v", v, ok)
+	}
+	if _, ok := root.GetFold("por"); ok {
+		t.Fatal("unexpected match")
+	}
+
+	content := `port = 80; Port = 443;`
+	if _, err := Parse("none", content, Flags{}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Parse("none", content, Flags{CaseInsensitiveKeys: true})
+	if err == nil || !strings.HasSuffix(err.Error(), "key 'Port' is not unique for current table, it differs only in case from 'port'") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = Parse("none", `a = { x = 1; X = 2; };`, Flags{CaseInsensitiveKeys: true})
+	if err == nil {
+		t.Fatal("expected error in nested table")
+	}
+
+	root, err = Parse("none", content, Flags{CaseInsensitiveKeys: true, AllowDuplicateKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(root) != 1 || root[0].Key != "Port" || root[0].Value.Data.Integer != 443 {
+		t.Fatalf("unexpected result: %v", root)
+	}
+}
+
+func TestKeyValuePosition(t *testing.T) {
+	root, err := Parse("none", `a = 1;
+  server = {
+      port = 80;
+  };
+[ 1; ];
+`, Flags{AnonymousSections: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		kv           KeyValue
+		line, column int
+	}{
+		{root[0], 1, 1},
+		{root[1], 2, 3},
+		{root[1].Value.Data.Table[0], 3, 7},
+		{root[2], 5, 1},
+	}
+	for _, test := range tests {
+		if test.kv.Line != test.line || test.kv.Column != test.column {
+			t.Errorf("%s: want %d:%d, have %d:%d", test.kv.Key, test.line, test.column, test.kv.Line, test.kv.Column)
+		}
+	}
+}
+
+func TestUnmarshalStrict(t *testing.T) {
+	type server struct {
+		Host string `kevs:"host"`
+	}
+	type data struct {
+		embeddedBase
+		Port    int      `kevs:"server.port"`
+		Server  server   `kevs:"server"`
+		Servers []server `kevs:"servers"`
+		Origin  point    `kevs:"origin"`
+		Skip    int      `kevs:"-"`
+	}
+
+	content := `
+name = "app";
+server = { host = "h"; port = 80; };
+servers = [ { host = "a"; }; ];
+origin = [ 1; 2; ];
+`
+	root, err := Parse("none", content, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d data
+	if err := root.UnmarshalStrict(&d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "app" || d.Port != 80 || d.Server.Host != "h" || len(d.Servers) != 1 {
+		t.Fatalf("unexpected result: %+v", d)
+	}
+
+	root, err = Parse("none", content+`
+nmae = "typo";
+server = { host = "h"; port = 80; hots = "x"; };
+servers = [ { host = "a"; }; { host = "b"; extra = 1; }; ];
+Skip = 1;
+`, Flags{AllowDuplicateKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = root.UnmarshalStrict(&d)
+	want := "struct 'data': unknown keys: 'server.hots', 'servers.1.extra', 'nmae', 'Skip'"
+	if err == nil || err.Error() != want {
+		t.Fatalf("want error %q, have %v", want, err)
+	}
+
+	// Unmarshal errors come first
+	root, err = Parse("none", `name = 1; unknown = 1;`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.UnmarshalStrict(&d); err == nil || strings.Contains(err.Error(), "unknown") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestHexEscape(t *testing.T) {
+	valid := []struct {
+		in  string
+		out string
+	}{
+		{`\x41`, "A"},
+		{`a\x41b`, "aAb"},
+		{`\x7f\x7F`, "\x7f\x7f"},
+		{`\xff`, "\xff"},
+		{`\xc3\xbc`, "ü"},
+	}
+	for _, test := range valid {
+		out, err := normString(test.in)
+		if err != nil {
+			t.Errorf("%s: %v", test.in, err)
+			continue
+		}
+		if out != test.out {
+			t.Errorf("%s: want %q, have %q", test.in, test.out, out)
+		}
+	}
+
+	invalid := []struct {
+		in  string
+		err string
+	}{
+		{`\xZZ`, `\x must be followed by 2 hex digits: invalid hex digit 'Z'`},
+		{`\x4`, `\x must be followed by 2 hex digits: \xHH`},
+		{`\x_1`, `\x must be followed by 2 hex digits: invalid hex digit '_'`},
+	}
+	for _, test := range invalid {
+		_, err := normString(test.in)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: want error %q, have %v", test.in, test.err, err)
+		}
+	}
+
+	// underscores are digit separators in integers only
+	if _, err := normString(`\u0_41`); err == nil {
+		t.Fatal("expected error for underscore in \\u escape")
+	}
+
+	root, err := Parse("none", `a = "\x41\x42";`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := root.GetString("a"); s != "AB" {
+		t.Fatalf("unexpected value: %q", s)
+	}
+}
+
+func TestOctalEscape(t *testing.T) {
+	valid := []struct {
+		in  string
+		out string
+	}{
+		{`\101`, "A"},
+		{`\0`, "\x00"},
+		{`\7a`, "\x07a"},
+		{`\12`, "\n"},
+		{`\1018`, "A8"},
+		{`\377`, "\xff"},
+		{`\303\274`, "ü"},
+		{`\n\101\t`, "\nA\t"},
+	}
+	for _, test := range valid {
+		out, err := normString(test.in)
+		if err != nil {
+			t.Errorf("%s: %v", test.in, err)
+			continue
+		}
+		if out != test.out {
+			t.Errorf("%s: want %q, have %q", test.in, test.out, out)
+		}
+
+		// same bytes as the equivalent hex escapes
+		var hex strings.Builder
+		for i := 0; i < len(out); i++ {
+			fmt.Fprintf(&hex, `\x%02x`, out[i])
+		}
+		back, err := normString(hex.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if back != out {
+			t.Errorf("%s: hex round-trip: want %q, have %q", test.in, out, back)
+		}
+	}
+
+	if _, err := normString(`\400`); err == nil || err.Error() != "octal escape value 256 is bigger than 255" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := normString(`\8`); err == nil {
+		t.Fatal("expected error for non-octal digit")
+	}
+}
+
+func TestSurrogateEscape(t *testing.T) {
+	out, err := normString(`\uD83D\uDE00`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "\U0001F600" {
+		t.Fatalf("want %q, have %q", "\U0001F600", out)
+	}
+	if out, err := normString(`a\uD83D\uDE00b`); err != nil || out != "a\U0001F600b" {
+		t.Fatalf("unexpected result: %q, %v", out, err)
+	}
+
+	lone := "lone surrogate \\uD800 is not a valid code point, use a surrogate pair or \\UXXXXXXXX for characters above U+FFFF"
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{`\uD800`, lone},
+		{`\uD800x`, lone},
+		{`\uD800A`, lone},
+		{`\uD800\uD800`, lone},
+		{`\uDE00`, strings.Replace(lone, "D800", "DE00", 1)},
+		{`\uD800\uZZZZ`, "invalid hex digit 'Z'"},
+		{`\U0000D800`, "surrogate \\U0000D800 is not a valid code point"},
+	}
+	for _, test := range tests {
+		_, err := normString(test.in)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: want error %q, have %v", test.in, test.err, err)
+		}
+	}
+}
+
+func TestHeredoc(t *testing.T) {
+	content := "text = <<END\n" +
+		"a `raw` and \"quoted\" text\n" +
+		"  indented \\n not an escape\n" +
+		"END;\n" +
+		"server = {\n" +
+		"    motd = <<EOT\n" +
+		"END;\n" +
+		"    EOT ;\n" +
+		"    empty = <<X\n" +
+		"    X;\n" +
+		"};\n" +
+		"after = 1\n"
+
+	_, err := Parse("none", content, Flags{})
+	if err == nil || !strings.HasPrefix(err.Error(), "none:12:") {
+		t.Fatalf("expected error at line 12, got %v", err)
+	}
+
+	root, err := Parse("none", content[:len(content)-1]+";\n", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text, _ := root.GetString("text")
+	if text != "a `raw` and \"quoted\" text\n  indented \\n not an escape\n" {
+		t.Fatalf("unexpected text: %q", text)
+	}
+	motd, _ := root.GetPath("server.motd")
+	if motd.Data.String != "END;\n" {
+		t.Fatalf("unexpected motd: %q", motd.Data.String)
+	}
+	empty, _ := root.GetPath("server.empty")
+	if empty.Kind != ValueKindString || empty.Data.String != "" {
+		t.Fatalf("unexpected empty: %v", empty)
+	}
+	if root[2].Line != 12 {
+		t.Fatalf("want line 12, have %d", root[2].Line)
+	}
+
+	for _, in := range []string{
+		"a = <<END\nno end\n",
+		"a = <<END\nEND\n",
+		"a = <<\nEND;\n",
+		"a = <<1X\n1X;\n",
+		"a = <<END",
+	} {
+		if _, err := Parse("none", in, Flags{}); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+func Test_dedent(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"", ""},
+		{"abc", "abc"},
+		{"\n    a\n    b\n    ", "a\nb\n"},
+		{"\n    a\n      b\n  ", "a\n  b\n"},
+		{"\n\ta\n\t\tb\n\t", "a\n\tb\n"},
+		{"\n\t  a\n\t b\n", " a\nb\n"},
+		{"\n\ta\n    b\n", "\ta\n    b\n"},
+		{"\n    a\n\n    b", "a\n\nb"},
+		{"\n    a\n  \t \n    b", "a\n\nb"},
+		{"first\n    a\n    b", "first\na\nb"},
+		{"  first\n    a\n      b\n    ", "  first\na\n  b\n"},
+	}
+	for _, test := range tests {
+		if out := dedent(test.in); out != test.out {
+			t.Errorf("%q: want %q, have %q", test.in, test.out, out)
+		}
+	}
+}
+
+func TestDedentRawStrings(t *testing.T) {
+	content := "server = {\n" +
+		"    motd = `\n" +
+		"        Welcome\n" +
+		"    \t  tabbed\n" +
+		"        bye\n" +
+		"    `;\n" +
+		"    text = <<END\n" +
+		"        a\n" +
+		"          b\n" +
+		"    END;\n" +
+		"    quoted = \"  kept\";\n" +
+		"};\n"
+
+	root, err := Parse("none", content, Flags{DedentRawStrings: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"server.motd":   "    Welcome\n\t  tabbed\n    bye\n",
+		"server.text":   "a\n  b\n",
+		"server.quoted": "  kept",
+	}
+	for path, w := range want {
+		v, err := root.GetPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Data.String != w {
+			t.Errorf("%s: want %q, have %q", path, w, v.Data.String)
+		}
+	}
+
+	root, err = Parse("none", content, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := root.GetPath("server.text"); v.Data.String != "        a\n          b\n" {
+		t.Fatalf("dedented without the flag: %q", v.Data.String)
+	}
+}
+
+func TestCoercion(t *testing.T) {
+	root, err := Parse("none", `
+i = 8080;
+hex = 0x10;
+s = "8080";
+shex = "-0x10";
+bad = "80a";
+t = true;
+f = false;
+n = null;
+big = 18446744073709551615;
+l = [];
+m = {};
+`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(key string) Value {
+		v, _ := root.Get(key)
+		return v
+	}
+
+	ints := []struct {
+		key string
+		n   int64
+	}{
+		{"i", 8080},
+		{"hex", 16},
+		{"s", 8080},
+		{"shex", -16},
+		{"t", 1},
+		{"f", 0},
+	}
+	for _, test := range ints {
+		n, err := get(test.key).AsInteger()
+		if err != nil {
+			t.Errorf("%s: %v", test.key, err)
+			continue
+		}
+		if n != test.n {
+			t.Errorf("%s: want %d, have %d", test.key, test.n, n)
+		}
+	}
+	for _, key := range []string{"bad", "n", "big", "l", "m"} {
+		if _, err := get(key).AsInteger(); err == nil {
+			t.Errorf("%s: expected error", key)
+		}
+	}
+	if _, err := get("bad").AsInteger(); err.Error() != "string '80a' is not an integer: invalid digit, bigger than base" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	strs := []struct {
+		key string
+		s   string
+	}{
+		{"i", "8080"},
+		{"hex", "16"},
+		{"s", "8080"},
+		{"t", "true"},
+		{"f", "false"},
+		{"n", "null"},
+		{"big", "18446744073709551615"},
+	}
+	for _, test := range strs {
+		s, err := get(test.key).AsString()
+		if err != nil {
+			t.Errorf("%s: %v", test.key, err)
+			continue
+		}
+		if s != test.s {
+			t.Errorf("%s: want %s, have %s", test.key, test.s, s)
+		}
+	}
+	for _, key := range []string{"l", "m"} {
+		if _, err := get(key).AsString(); err == nil {
+			t.Errorf("%s: expected error", key)
+		}
+	}
+
+	if _, err := root.GetInteger("s"); err == nil {
+		t.Fatal("GetInteger must not coerce")
+	}
+}
+
+func TestSetDelete(t *testing.T) {
+	var root Table
+
+	root.Set("a", IntegerValue(1))
+	root.Set("b", IntegerValue(1))
+	root.Set("c", IntegerValue(1))
+	root.Set("b", IntegerValue(2))
+	if len(root) != 3 || root[1].Key != "b" || root[1].Value.Data.Integer != 2 {
+		t.Fatalf("unexpected table: %v", root)
+	}
+
+	if !root.Delete("a") {
+		t.Fatal("key not deleted")
+	}
+	if root.Delete("a") || root.Delete("missing") {
+		t.Fatal("deleted a missing key")
+	}
+	if len(root) != 2 || root[0].Key != "b" || root[1].Key != "c" {
+		t.Fatalf("unexpected table: %v", root)
+	}
+
+	out, err := Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "b = 2;\nc = 1;\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestValueConstructors(t *testing.T) {
+	tests := []struct {
+		have Value
+		want Value
+	}{
+		{StringValue("x"), Value{Kind: ValueKindString, Data: ValueData{String: "x"}}},
+		{IntegerValue(-1), Value{Kind: ValueKindInteger, Data: ValueData{Integer: -1}}},
+		{BooleanValue(true), Value{Kind: ValueKindBoolean, Data: ValueData{Boolean: true}}},
+		{NullValue(), Value{Kind: ValueKindNull}},
+		{ListValue(), Value{Kind: ValueKindList}},
+		{
+			ListValue(IntegerValue(1), StringValue("a")),
+			Value{Kind: ValueKindList, Data: ValueData{List: List{
+				{Kind: ValueKindInteger, Data: ValueData{Integer: 1}},
+				{Kind: ValueKindString, Data: ValueData{String: "a"}},
+			}}},
+		},
+		{
+			TableValue(Table{{Key: "a", Value: BooleanValue(false)}}),
+			Value{Kind: ValueKindTable, Data: ValueData{Table: Table{
+				{Key: "a", Value: Value{Kind: ValueKindBoolean}},
+			}}},
+		},
+	}
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.have, test.want) {
+			t.Errorf("want %v, have %v", test.want, test.have)
+		}
+	}
+
+	root := Table{
+		{Key: "name", Value: StringValue("app")},
+		{Key: "ports", Value: ListValue(IntegerValue(80), IntegerValue(443))},
+		{Key: "tls", Value: TableValue(Table{{Key: "enabled", Value: BooleanValue(true)}})},
+		{Key: "proxy", Value: NullValue()},
+	}
+	out, err := Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "name = \"app\";\nports = [\n    80;\n    443;\n];\ntls = {\n    enabled = true;\n};\nproxy = null;\n"
+	if string(out) != want {
+		t.Fatalf("want %q, have %q", want, out)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	parse := func(content string) Table {
+		t.Helper()
+		root, err := Parse("none", content, Flags{AllowDuplicateKeys: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root
+	}
+
+	a := parse(`n = 16; s = "x"; l = [ 1; { x = true; y = null; }; ]; t = { a = 1; b = [ 2; ]; };`)
+	b := parse(`
+# same values, other positions and bases
+n = 0x10;
+s = "x";
+l = [ 1; { x = true; y = null; }; ];
+t = { a = 1; b = [ 2; ]; };
+`)
+	if !a.Equal(b) || !b.Equal(a) || !a.EqualUnordered(b) {
+		t.Fatal("tables should be equal")
+	}
+
+	reordered := parse(`t = { b = [ 2; ]; a = 1; }; s = "x"; n = 16; l = [ 1; { y = null; x = true; }; ];`)
+	if a.Equal(reordered) {
+		t.Fatal("order should matter")
+	}
+	if !a.EqualUnordered(reordered) || !reordered.EqualUnordered(a) {
+		t.Fatal("order should not matter")
+	}
+
+	different := []string{
+		`n = 17; s = "x"; l = [ 1; { x = true; y = null; }; ]; t = { a = 1; b = [ 2; ]; };`,
+		`n = "16"; s = "x"; l = [ 1; { x = true; y = null; }; ]; t = { a = 1; b = [ 2; ]; };`,
+		`n = 16; s = "x"; l = [ { x = true; y = null; }; 1; ]; t = { a = 1; b = [ 2; ]; };`,
+		`n = 16; s = "x"; l = [ 1; { x = true; y = 0; }; ]; t = { a = 1; b = [ 2; ]; };`,
+		`n = 16; s = "x"; l = [ 1; { x = true; y = null; }; ]; t = { a = 1; b = [ 2; 3; ]; };`,
+		`n = 16; s = "x"; l = [ 1; { x = true; y = null; }; ]; t = { a = 1; c = [ 2; ]; };`,
+		`n = 16; s = "x"; l = [ 1; { x = true; y = null; }; ]; t = { a = 1; b = [ 2; ]; }; extra = 1;`,
+		`n = 16; s = "x"; l = [ 1; { x = true; y = null; }; ];`,
+	}
+	for _, content := range different {
+		other := parse(content)
+		if a.Equal(other) || a.EqualUnordered(other) || other.EqualUnordered(a) {
+			t.Errorf("%s: should not be equal", content)
+		}
+	}
+
+	// parsed tables have unique keys, so build the duplicates by hand
+	twice := Table{{Key: "a", Value: IntegerValue(1)}, {Key: "a", Value: IntegerValue(1)}}
+	mixed := Table{{Key: "a", Value: IntegerValue(1)}, {Key: "b", Value: IntegerValue(2)}}
+	if twice.EqualUnordered(mixed) || mixed.EqualUnordered(twice) {
+		t.Fatal("duplicate keys should be matched one-to-one")
+	}
+	swapped := Table{{Key: "a", Value: IntegerValue(2)}, {Key: "a", Value: IntegerValue(1)}}
+	pair := Table{{Key: "a", Value: IntegerValue(1)}, {Key: "a", Value: IntegerValue(2)}}
+	if !swapped.EqualUnordered(pair) || !pair.EqualUnordered(swapped) || swapped.EqualUnordered(twice) {
+		t.Fatal("unexpected comparison of duplicate keys")
+	}
+
+	if !IntegerValue(1).Equal(IntegerValue(1)) || IntegerValue(1).Equal(BooleanValue(true)) {
+		t.Fatal("unexpected scalar comparison")
+	}
+	big := parse(`a = 18446744073709551615; b = 18446744073709551614;`)
+	if big[0].Value.Equal(big[1].Value) {
+		t.Fatal("unsigned values should differ")
+	}
+}
+
+func TestParseTokensTruncated(t *testing.T) {
+	// the tokens of a file ending right after "key ="
+	tokens := []Token{
+		{Kind: TokenKindKey, Value: "key", Line: 3, Column: 1},
+		{Kind: TokenKindDelim, Value: "=", Line: 3, Column: 5},
+	}
+	want := "none:3:5: error: parse: expected value token, found nothing"
+
+	_, err := ParseTokens("none", "", Flags{}, tokens)
+	if err == nil || err.Error() != want {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// with AbortOnError the first parse error is the panic value
+	defer func() {
+		err, ok := recover().(*Error)
+		if !ok || err.Line != 3 || err.Column != 5 {
+			t.Fatalf("unexpected panic: %v", err)
+		}
+	}()
+	_, _ = ParseTokens("none", "", Flags{AbortOnError: true}, tokens)
+	t.Fatal("expected panic")
+}
+
+func TestEmptyInput(t *testing.T) {
+	inputs := []string{
+		"",
+		"   ",
+		"   \n\n",
+		"\t\n \n\t",
+		"# comment",
+		"# comment ",
+		"# a\n# b\n  ",
+		"\n# comment\n   ",
+	}
+	for _, content := range inputs {
+		for _, flags := range []Flags{{}, {KeepSpace: true}, {KeepComments: true}, {CollectAll: true}} {
+			root, err := Parse("none", content, flags)
+			if err != nil {
+				t.Errorf("%q: %v", content, err)
+				continue
+			}
+			if len(root) != 0 {
+				t.Errorf("%q: expected empty table, have %v", content, root)
+			}
+		}
+
+		ts := NewScanner("none", content, Flags{})
+		if tok, ok := ts.Next(); ok {
+			t.Errorf("%q: unexpected token %v", content, tok)
+		}
+		if err := ts.Err(); err != nil {
+			t.Errorf("%q: %v", content, err)
+		}
+	}
+
+	root, err := Parse("none", "a = 1;   ", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(root) != 1 {
+		t.Fatalf("unexpected table: %v", root)
+	}
+}
+
+func TestInvalidKeyCharacter(t *testing.T) {
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{"my key = 1;", "none:1:3: error: scan: invalid character ' ' in key 'my key'"},
+		{"a = 1;\n  server..port = 1;", "none:2:10: error: scan: invalid character '.' in key 'server..port'"},
+		{".port = 1;", "none:1:1: error: scan: invalid character '.' in key '.port'"},
+		{"server. = 1;", "none:1:7: error: scan: invalid character '.' in key 'server.'"},
+		{"server.1 = 1;", "none:1:8: error: scan: invalid character '1' in key 'server.1'"},
+		{"log-level = 1;", "none:1:4: error: scan: invalid character '-' in key 'log-level'"},
+		{"1abc = 1;", "none:1:1: error: scan: invalid character '1' in key '1abc'"},
+		{"café = 1;", "none:1:4: error: scan: invalid character 'é' in key 'café'"},
+	}
+	for _, test := range tests {
+		_, err := Parse("none", test.in, Flags{})
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%q: want error %q, have %v", test.in, test.err, err)
+		}
+	}
+
+	flags := Flags{IdentifierFunc: func(s string) bool { return true }}
+	root, err := Parse("none", "log-level = 1;", flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := root.Get("log-level"); !ok {
+		t.Fatal("key not found")
+	}
+}
+
+func TestDottedKeys(t *testing.T) {
+	content := `
+name = "x";
+server.host = "a";
+# the port
+server.port = 80;
+server.tls.cert = "c";
+server.tls.key = "k";
+db = { user = "u"; };
+db.pass = "p";
+list = [ { a.b = 1; }; ];
+`
+	root, err := Parse("none", content, Flags{KeepComments: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := mustParse(t, `
+name = "x";
+server = { host = "a"; port = 80; tls = { cert = "c"; key = "k"; }; };
+db = { user = "u"; pass = "p"; };
+list = [ { a = { b = 1; }; }; ];
+`)
+	if !root.Equal(want) {
+		t.Fatalf("unexpected table: %v", root)
+	}
+
+	port, err := root.GetPath("server.port")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port.Data.Integer != 80 {
+		t.Fatalf("unexpected port: %d", port.Data.Integer)
+	}
+	server, _ := root.Get("server")
+	if kv := server.Data.Table[1]; kv.Line != 5 || kv.Column != 1 || !slices.Equal(kv.Comments, []string{"# the port"}) {
+		t.Fatalf("unexpected key-value: %+v", kv)
+	}
+
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{"server = 1; server.host = \"a\";", "none:1:13: error: parse: key 'server.host' conflicts with 'server', which is not a table"},
+		{"a = { b = 1; }; a.b.c = 1;", "none:1:17: error: parse: key 'a.b.c' conflicts with 'a.b', which is not a table"},
+		{"server.host = \"a\"; server.host = \"b\";", "none:1:20: error: parse: key 'server.host' is not unique for current table"},
+		{"server.host = \"a\"; server = {};", "none:1:20: error: parse: key 'server' is not unique for current table"},
+		{"t = { a.b = 1; a = 2; };", "none:1:16: error: parse: key 'a' is not unique for current table"},
+	}
+	for _, test := range tests {
+		_, err := Parse("none", test.in, Flags{})
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%q: want error %q, have %v", test.in, test.err, err)
+		}
+	}
+
+	root, err = Parse("none", "Server.host = \"a\"; server.PORT = 1;", Flags{CaseInsensitiveKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equal(mustParse(t, "Server = { host = \"a\"; PORT = 1; };")) {
+		t.Fatalf("unexpected table: %v", root)
+	}
+	if _, err := Parse("none", "server.host = \"a\"; SERVER.Host = \"b\";", Flags{CaseInsensitiveKeys: true}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestTrailingContent(t *testing.T) {
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{"a = 1; }", "none:1:8: error: scan: stray delimiter '}'"},
+		{"a = 1;\n;\n", "none:2:1: error: scan: stray delimiter ';'"},
+		{"a = 1; ]", "none:1:8: error: scan: stray delimiter ']'"},
+		{"a = { b = 1; }; };", "none:1:17: error: scan: stray delimiter '}'"},
+		{"a = 1; ; b = 2;", "none:1:8: error: scan: stray delimiter ';'"},
+		{"a = 1;\nsome text\n", "none:2:1: error: scan: unexpected content after the last key-value pair"},
+		{"a = 1; b", "none:1:8: error: scan: unexpected content after the last key-value pair"},
+	}
+	for _, test := range tests {
+		_, err := Parse("none", test.in, Flags{})
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%q: want error %q, have %v", test.in, test.err, err)
+		}
+	}
+
+	for _, content := range []string{"a = 1; }", "a = 1;\n;\n", "a = 1;\nsome text\n", "a = 1; } ] ;"} {
+		root, err := Parse("none", content, Flags{AllowTrailingContent: true})
+		if err != nil {
+			t.Fatalf("%q: %v", content, err)
+		}
+		if !root.Equal(mustParse(t, "a = 1;")) {
+			t.Fatalf("%q: unexpected table: %v", content, root)
+		}
+	}
+	if _, err := Parse("none", "a = 1; } b = 2;", Flags{AllowTrailingContent: true}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	key := Token{Kind: TokenKindKey, Value: "a", Line: 1, Column: 1}
+	sep := Token{Kind: TokenKindDelim, Value: "=", Line: 1, Column: 3}
+	val := Token{Kind: TokenKindValue, Value: "1", Line: 1, Column: 5}
+	end := Token{Kind: TokenKindDelim, Value: ";", Line: 1, Column: 6}
+	stray := Token{Kind: TokenKindDelim, Value: "}", Line: 1, Column: 8}
+
+	tokens := []Token{key, sep, val, end, stray}
+	if _, err := ParseTokens("none", "", Flags{}, tokens); err == nil || err.Error() != "none:1:8: error: parse: stray delimiter '}'" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	root, err := ParseTokens("none", "", Flags{AllowTrailingContent: true}, tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(root) != 1 {
+		t.Fatalf("unexpected table: %v", root)
+	}
+
+	_, err = ParseTokens("none", "", Flags{CollectAll: true}, []Token{stray, key, sep, val, end, stray})
+	if err == nil || strings.Count(err.Error(), "stray delimiter") != 2 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestFloats(t *testing.T) {
+	root, err := Parse("none", `
+rate = 1e6;
+small = 2.5e-3;
+big = 1.5E+10;
+neg = -0.25;
+pos = +3.0;
+sep = 1_000.000_5;
+zero = 0.0;
+exp = 0e0;
+int = 42;
+`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]float64{
+		"rate":  1e6,
+		"small": 2.5e-3,
+		"big":   1.5e10,
+		"neg":   -0.25,
+		"pos":   3,
+		"sep":   1000.0005,
+		"zero":  0,
+		"exp":   0,
+	}
+	for key, f := range want {
+		v, _ := root.Get(key)
+		if v.Kind != ValueKindFloat || v.Data.Float != f {
+			t.Errorf("%s: want float %g, have %s %v", key, f, v.Kind, v)
+		}
+	}
+	if n, err := root.GetFloat("int"); err != nil || n != 42 {
+		t.Errorf("unexpected integer as float: %v %v", n, err)
+	}
+	if _, err := root.GetInteger("rate"); err == nil {
+		t.Error("expected error for float as integer")
+	}
+
+	invalid := []string{
+		"1e", "1e+", "1.", ".5", "-.5", "1.e5", "01.5", "1__0.5", "_1.0", "1.0_", "1.5x",
+		"1e400", "0x1p4", "0x1.8p1", "inf", "nan", "1.2.3", "1e5e5",
+	}
+	for _, val := range invalid {
+		if _, err := Parse("none", "a = "+val+";", Flags{}); err == nil {
+			t.Errorf("%s: expected error", val)
+		}
+	}
+
+	// barewords containing e or a dot are not floats
+	for _, val := range []string{"yes", "enabled", "e5", "-e", "v1.2"} {
+		_, err := Parse("none", "a = "+val+";", Flags{})
+		want := "none:1:5: error: parse: value '" + val + "' is not an integer"
+		if err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%s: want error %q, have %v", val, want, err)
+		}
+	}
+
+	// hex integers containing e are not floats
+	root, err = Parse("none", "a = 0x1e;", Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := root.GetInteger("a"); n != 0x1e {
+		t.Fatalf("unexpected value: %d", n)
+	}
+}
+
+func TestUnmarshalFloats(t *testing.T) {
+	type data struct {
+		Rate   float64   `kevs:"rate"`
+		Ratio  float32   `kevs:"ratio"`
+		Whole  float64   `kevs:"whole"`
+		Values []float64 `kevs:"values"`
+	}
+	root := mustParse(t, "rate = 2.5e-3; ratio = 0.5; whole = 3; values = [ 1.5; 2; -1e3; ];")
+	var d data
+	if err := root.Unmarshal(&d); err != nil {
+		t.Fatal(err)
+	}
+	want := data{Rate: 2.5e-3, Ratio: 0.5, Whole: 3, Values: []float64{1.5, 2, -1e3}}
+	if !reflect.DeepEqual(d, want) {
+		t.Fatalf("want %+v, have %+v", want, d)
+	}
+
+	var small struct {
+		F float32 `kevs:"f"`
+	}
+	if err := mustParse(t, "f = 1e300;").Unmarshal(&small); err == nil {
+		t.Fatal("expected overflow error")
+	}
+	if err := mustParse(t, `f = "1.5";`).Unmarshal(&small); err == nil {
+		t.Fatal("expected error for string")
+	}
+}
+
+func TestToMap(t *testing.T) {
+	root := mustParse(t, `
+s = "x";
+i = -1;
+u = 18446744073709551615;
+f = 2.5;
+b = true;
+n = null;
+l = [ 1; "a"; [ false; ]; { k = "v"; }; ];
+t = { a = { b = 1; }; e = {}; };
+e = [];
+`)
+	want := map[string]any{
+		"s": "x",
+		"i": int64(-1),
+		"u": uint64(math.MaxUint64),
+		"f": 2.5,
+		"b": true,
+		"n": nil,
+		"l": []any{int64(1), "a", []any{false}, map[string]any{"k": "v"}},
+		"t": map[string]any{"a": map[string]any{"b": int64(1)}, "e": map[string]any{}},
+		"e": []any{},
+	}
+	if have := root.ToMap(); !reflect.DeepEqual(have, want) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+
+	if have := (Table{}).ToMap(); len(have) != 0 || have == nil {
+		t.Fatalf("unexpected map: %v", have)
+	}
+}
+
+func TestGetterErrors(t *testing.T) {
+	root := mustParse(t, `s = "x"; i = 1; t = { a = 1; }; d = true;`)
+	index := root.Index()
+
+	notFound := []error{}
+	_, err := root.GetString("missing")
+	notFound = append(notFound, err)
+	_, err = index.GetInteger("missing")
+	notFound = append(notFound, err)
+	_, err = root.GetPath("t.missing")
+	notFound = append(notFound, err)
+	for _, err := range notFound {
+		if !errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrWrongType) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	type wrongType struct {
+		err      error
+		expected ValueKind
+		actual   ValueKind
+	}
+	var wrong []wrongType
+	_, err = root.GetString("i")
+	wrong = append(wrong, wrongType{err, ValueKindString, ValueKindInteger})
+	_, err = root.GetInteger("s")
+	wrong = append(wrong, wrongType{err, ValueKindInteger, ValueKindString})
+	_, err = root.GetUint("s")
+	wrong = append(wrong, wrongType{err, ValueKindInteger, ValueKindString})
+	_, err = root.GetFloat("d")
+	wrong = append(wrong, wrongType{err, ValueKindFloat, ValueKindBoolean})
+	_, err = root.GetBoolean("t")
+	wrong = append(wrong, wrongType{err, ValueKindBoolean, ValueKindTable})
+	_, err = index.GetTable("s")
+	wrong = append(wrong, wrongType{err, ValueKindTable, ValueKindString})
+	_, err = index.GetList("i")
+	wrong = append(wrong, wrongType{err, ValueKindList, ValueKindInteger})
+	for _, test := range wrong {
+		if !errors.Is(test.err, ErrWrongType) || errors.Is(test.err, ErrKeyNotFound) {
+			t.Errorf("unexpected error: %v", test.err)
+		}
+		var typeErr *TypeError
+		if !errors.As(test.err, &typeErr) || typeErr.Expected != test.expected || typeErr.Actual != test.actual {
+			t.Errorf("unexpected error: %v", test.err)
+		}
+	}
+
+	if _, err := root.GetDuration("d"); !errors.Is(err, ErrWrongType) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestGetterErrorMessages(t *testing.T) {
+	root := mustParse(t, `port = 8080; name = "x"; big = 18446744073709551615; t = {}; d = "1x";`)
+	index := root.Index()
+
+	check := func(err error, want string) {
+		t.Helper()
+		if err == nil || err.Error() != want {
+			t.Errorf("want error %q, have %v", want, err)
+		}
+	}
+
+	_, err := root.GetString("port")
+	check(err, "key 'port': value is integer, expected string")
+	_, err = index.GetString("port")
+	check(err, "key 'port': value is integer, expected string")
+	_, err = root.GetInteger("name")
+	check(err, "key 'name': value is string, expected integer")
+	_, err = root.GetInteger("big")
+	check(err, "key 'big': value 18446744073709551615 overflows int64")
+	_, err = root.GetUint("name")
+	check(err, "key 'name': value is string, expected integer")
+	_, err = index.GetFloat("t")
+	check(err, "key 't': value is table, expected float")
+	_, err = root.GetBoolean("port")
+	check(err, "key 'port': value is integer, expected boolean")
+	_, err = root.GetTable("port")
+	check(err, "key 'port': value is integer, expected table")
+	_, err = index.GetList("t")
+	check(err, "key 't': value is table, expected list")
+	_, err = root.GetTime("port")
+	check(err, "key 'port': value is integer, expected string")
+	_, err = root.GetDuration("t")
+	check(err, "key 't': value is table, expected string or integer: wrong type")
+	_, err = root.GetDuration("d")
+	check(err, `key 'd': time: unknown unit "x" in duration "1x"`)
+	_, err = root.GetString("missing")
+	check(err, "key 'missing': key not found")
+	_, err = index.GetBoolean("missing")
+	check(err, "key 'missing': key not found")
+}
+
+func TestCommentPrefix(t *testing.T) {
+	content := `
+// server settings
+server = { // inline
+    host = "h"; // the host
+    # not a comment
+};
+ports = [
+    // first
+    80;
+    443; // last
+];
+url = "http://x"; // slashes in strings are kept
+`
+	_, err := Parse("none", content, Flags{})
+	if err == nil {
+		t.Fatal("expected error with the default prefix")
+	}
+
+	content = strings.Replace(content, "    # not a comment\n", "", 1)
+	root, err := Parse("none", content, Flags{CommentPrefix: "//", KeepComments: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustParse(t, `server = { host = "h"; }; ports = [ 80; 443; ]; url = "http://x";`)
+	if !root.Equal(want) {
+		t.Fatalf("unexpected table: %v", root)
+	}
+	if !slices.Equal(root[0].Comments, []string{"// server settings"}) {
+		t.Fatalf("unexpected comments: %q", root[0].Comments)
+	}
+
+	if _, err := Parse("none", "# x\na = 1;", Flags{CommentPrefix: "//"}); err == nil {
+		t.Fatal("expected error for # with the // prefix")
+	}
+	if _, err := Parse("none", "%% x\na = 1; %% y", Flags{CommentPrefix: "%%"}); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []string{";", ";;", "=", "[", "{", "\"", "`", "<", " #", "\n"}
+	// these would swallow keys and values, e.g. REMOTE = 1; or [ -1; ]
+	invalid = append(invalid, "REM", "r", "0", "--", "-", "+", "_", ".", "@")
+	for _, prefix := range invalid {
+		_, err := Parse("none", "a = 1;", Flags{CommentPrefix: prefix})
+		if err == nil || !strings.Contains(err.Error(), "flag CommentPrefix cannot start with") {
+			t.Errorf("%q: unexpected error: %v", prefix, err)
+		}
+	}
+}
+
+func TestBOM(t *testing.T) {
+	content := "key = 1;\n# comment\nt = { a = \"x\"; };\n"
+	want := mustParse(t, content)
+
+	root, err := Parse("none", utf8BOM+content, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equal(want) {
+		t.Fatalf("unexpected table: %v", root)
+	}
+	if root[0].Line != 1 || root[0].Column != 1 {
+		t.Fatalf("unexpected position: %d:%d", root[0].Line, root[0].Column)
+	}
+
+	tokens, err := Scan("none", utf8BOM+content, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens[0].Value != "key" {
+		t.Fatalf("unexpected token: %v", tokens[0])
+	}
+
+	docs, err := ParseAll("none", utf8BOM+"---\n"+content, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || !docs[0].Equal(want) {
+		t.Fatalf("unexpected documents: %v", docs)
+	}
+
+	// only a leading BOM is skipped
+	if _, err := Parse("none", content+utf8BOM+"b = 1;", Flags{}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestCRLF(t *testing.T) {
+	content := "# settings\nname = \"app\";\nport = 8080; # the port\nraw = `a\nb`;\nt = {\n    x = true;\n};\nl = [\n    1;\n    2;\n];\ndoc = <<EOF\nline\nEOF;\n"
+
+	want, err := Parse("none", content, Flags{KeepComments: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, eol := range []string{"\r\n", "\r"} {
+		in := strings.ReplaceAll(content, "\n", eol)
+		root, err := Parse("none", in, Flags{KeepComments: true})
+		if err != nil {
+			t.Fatalf("%q: %v", eol, err)
+		}
+		if !root.Equal(want) || !reflect.DeepEqual(root, want) {
+			t.Fatalf("%q: want %v, have %v", eol, want, root)
+		}
+	}
+
+	_, err = Parse("none", "a = 1;\r\nb = ;\r\n", Flags{})
+	if err == nil || !strings.HasPrefix(err.Error(), "none:2:") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCRInQuotedString(t *testing.T) {
+	tests := []struct {
+		in    string
+		flags Flags
+		want  string
+	}{
+		{"s = \"x\ry\";\r\n", Flags{}, "x\ry"},
+		{"s = \"x\r\ny\";\r\n", Flags{}, "x\r\ny"},
+		{"s = \"\\\"\r\";\r", Flags{}, "\"\r"},
+		// quotes which do not start a string
+		{"# don't \"\r\ns = \"x\ry\";\r\n", Flags{}, "x\ry"},
+		{"// \"\rs = \"x\ry\";\r", Flags{CommentPrefix: "//"}, "x\ry"},
+		{"r = `\"`;\r\ns = \"x\ry\";\r\n", Flags{}, "x\ry"},
+		{"h = <<EOF\r\n\"\r\nEOF;\r\ns = \"x\ry\";\r\n", Flags{}, "x\ry"},
+	}
+	for _, test := range tests {
+		root, err := Parse("none", test.in, test.flags)
+		if err != nil {
+			t.Fatalf("%q: %v", test.in, err)
+		}
+		s, err := root.GetString("s")
+		if err != nil {
+			t.Fatalf("%q: %v", test.in, err)
+		}
+		if s != test.want {
+			t.Errorf("%q: want %q, have %q", test.in, test.want, s)
+		}
+	}
+
+	// the CRs outside the string are still line endings
+	_, err := Parse("none", "s = \"x\ry\";\r\nb = ;\r\n", Flags{})
+	if err == nil || !strings.HasPrefix(err.Error(), "none:2:") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	out, err := Format("s = \"x\ry\";\r\nt = 1;\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "s = \"x\ry\" ;\nt = 1 ;\n"; string(out) != want {
+		t.Fatalf("want %q, have %q", want, out)
+	}
+}
+
+func TestReferences(t *testing.T) {
+	flags := Flags{AllowReferences: true}
+	root, err := Parse("none", `
+base = { timeout = 5; hosts = [ "a"; "b"; ]; };
+prod = @base;
+timeout = @base.timeout;
+first = @base.hosts.0;
+list = [ @timeout; @base.hosts; ];
+nested = { t = @prod.timeout; };
+base.extra = @timeout;
+`, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustParse(t, `
+base = { timeout = 5; hosts = [ "a"; "b"; ]; extra = 5; };
+prod = { timeout = 5; hosts = [ "a"; "b"; ]; };
+timeout = 5;
+first = "a";
+list = [ 5; [ "a"; "b"; ]; ];
+nested = { t = 5; };
+`)
+	if !root.Equal(want) {
+		t.Fatalf("unexpected table: %v", root)
+	}
+
+	// references are copies
+	hosts, _ := root.GetPath("prod.hosts")
+	hosts.Data.List[0].Data.String = "x"
+	if v, _ := root.GetPath("base.hosts.0"); v.Data.String != "a" {
+		t.Fatal("reference shares data with its target")
+	}
+
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{"a = @b; b = 1;", "none:1:5: error: parse: reference '@b' is not defined before: path 'b': key not found"},
+		{"a = @a;", "none:1:5: error: parse: reference '@a' is a cycle, it refers to a value being defined"},
+		{"a = { b = [ @a.b; ]; };", "none:1:13: error: parse: reference '@a.b' is a cycle, it refers to a value being defined"},
+		{"a = { x = 1; }; a.y = @a;", "none:1:23: error: parse: reference '@a' is a cycle, it refers to a value being defined"},
+		{"a = 1; b = @a.c;", "none:1:12: error: parse: reference '@a.c' is not defined before: path 'a': value is integer, expected table"},
+		{"a = @;", "none:1:5: error: parse: empty reference"},
+	}
+	for _, test := range tests {
+		_, err := Parse("none", test.in, flags)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%q: want error %q, have %v", test.in, test.err, err)
+		}
+	}
+
+	root, err = Parse("none", "a = { x = 1; }; a.y = @a.x;", flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equal(mustParse(t, "a = { x = 1; y = 1; };")) {
+		t.Fatalf("unexpected table: %v", root)
+	}
+
+	if _, err := Parse("none", "a = 1; b = @a;", Flags{}); err == nil {
+		t.Fatal("expected error without AllowReferences")
+	}
+}
+
+func TestReferencesEnclosing(t *testing.T) {
+	flags := Flags{AllowReferences: true}
+	root, err := Parse("none", `
+t = { x = 1; y = @t.x; u = { z = @t.x; w = @t.u.z; }; };
+l = [ { x = 2; y = @l.0.x; }; ];
+a.b = { x = 3; y = @a.b.x; };
+`, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustParse(t, `
+t = { x = 1; y = 1; u = { z = 1; w = 1; }; };
+l = [ { x = 2; y = 2; }; ];
+a.b = { x = 3; y = 3; };
+`)
+	if !root.Equal(want) {
+		t.Fatalf("unexpected table: %v", root)
+	}
+
+	tests := []string{
+		"t = { x = 1; y = @t; };",
+		"l = [ 1; @l.0; ];",
+		"t = { x = @t.y; y = 1; };",
+	}
+	for _, in := range tests {
+		if _, err := Parse("none", in, flags); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+func TestReferencesDuplicateKeys(t *testing.T) {
+	flags := Flags{AllowReferences: true, AllowDuplicateKeys: true}
+	root, err := Parse("none", "a = 1; a = @a; b = { x = 1; }; b = { x = 2; y = @b.x; }; c = { x = 1; }; c = [ @c; ];", flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equal(mustParse(t, "a = 1; b = { x = 2; y = 2; }; c = [ { x = 1; }; ];")) {
+		t.Fatalf("unexpected table: %v", root)
+	}
+
+	_, err = Parse("none", "a = @a;", flags)
+	want := "none:1:5: error: parse: reference '@a' is a cycle, it refers to a value being defined"
+	if err == nil || err.Error() != want {
+		t.Fatalf("want error %q, have %v", want, err)
+	}
+}
+
+func TestReferencesLimit(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("a0 = [ 1; 1; 1; 1; 1; 1; 1; 1; ];\n")
+	for i := 1; i < 10; i++ {
+		fmt.Fprintf(&b, "a%d = [ @a%d; @a%d; @a%d; @a%d; @a%d; @a%d; @a%d; @a%d; ];\n", i, i-1, i-1, i-1, i-1, i-1, i-1, i-1, i-1)
+	}
+	_, err := Parse("none", b.String(), Flags{AllowReferences: true})
+	if err == nil || !strings.Contains(err.Error(), "copies too many values") {
+		t.Fatalf("want too many values error, have %v", err)
+	}
+}
+
+func TestScanInto(t *testing.T) {
+	content := `a = 1; b = [ "x"; { c = true; }; ];`
+	want, err := Scan("none", content, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]Token, 3, 64)
+	tokens, err := ScanInto("none", content, Flags{}, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tokens, want) {
+		t.Fatalf("want %v, have %v", want, tokens)
+	}
+	if &tokens[0] != &buf[:1][0] {
+		t.Fatal("buffer not reused")
+	}
+
+	if tokens, err := ScanInto("none", "a = ;;", Flags{}, buf); err == nil || tokens != nil {
+		t.Fatalf("unexpected result: %v %v", tokens, err)
+	}
+}
+
+var benchContent = strings.Repeat(`name = "app"; port = 8080; tags = [ "a"; "b"; ]; server = { host = "h"; debug = true; };
+`, 50)
+
+func BenchmarkScan(b *testing.B) {
+	b.ReportAllocs()
+	for range b.N {
+		if _, err := Scan("none", benchContent, Flags{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkScanInto(b *testing.B) {
+	b.ReportAllocs()
+	var buf []Token
+	for range b.N {
+		var err error
+		buf, err = ScanInto("none", benchContent, Flags{}, buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestStringEscapesScan(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{`"x\\\"y"`, `x\"y`},
+		{`"\"\"\""`, `"""`},
+		{`"\\\\"`, `\\`},
+		{`"\\\\\""`, `\\"`},
+		{`"a\"; b = \"c"`, `a"; b = "c`},
+	}
+	for _, test := range tests {
+		root, err := Parse("none", "a = "+test.in+";", Flags{})
+		if err != nil {
+			t.Errorf("%s: %v", test.in, err)
+			continue
+		}
+		if s, _ := root.GetString("a"); s != test.out {
+			t.Errorf("%s: want %q, have %q", test.in, test.out, s)
+		}
+	}
+
+	for _, in := range []string{`a = "abc\";`, `a = "abc\`, `a = "abc\\\";`, `a = "`} {
+		_, err := Parse("none", in, Flags{})
+		if err == nil || !strings.HasSuffix(err.Error(), "string value does not end with quote") {
+			t.Errorf("%s: unexpected error: %v", in, err)
+		}
+	}
+}
+
+func BenchmarkScanEscapedString(b *testing.B) {
+	content := `a = "` + strings.Repeat(`\"`, 10000) + `";`
+	b.ReportAllocs()
+	var buf []Token
+	for range b.N {
+		var err error
+		buf, err = ScanInto("none", content, Flags{}, buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestStringEscapedBackslashBeforeQuote(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{`"\\"`, `\`},
+		{`"\\\""`, `\"`},
+		{`"a\\b"`, `a\b`},
+		{`"a\\"`, `a\`},
+	}
+	for _, test := range tests {
+		for _, content := range []string{
+			"a = " + test.in + ";",
+			"a = [ " + test.in + "; ];",
+			"a = { b = " + test.in + "; };",
+		} {
+			root, err := Parse("none", content, Flags{})
+			if err != nil {
+				t.Errorf("%s: %v", content, err)
+				continue
+			}
+			v, _ := root.Get("a")
+			switch v.Kind {
+			case ValueKindList:
+				v = v.Data.List[0]
+			case ValueKindTable:
+				v = v.Data.Table[0].Value
+			}
+			if v.Data.String != test.out {
+				t.Errorf("%s: want %q, have %q", content, test.out, v.Data.String)
+			}
+		}
+	}
+}
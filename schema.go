@@ -0,0 +1,80 @@
+package kevs
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// Schema describes the expected keys of a table.
+type Schema map[string]FieldSpec
+
+// FieldSpec describes the expected value of a key.
+type FieldSpec struct {
+	// Kind is the expected kind of the value, ValueKindUndefined accepts
+	// any kind.
+	Kind ValueKind
+
+	// Required makes a missing key a violation.
+	Required bool
+
+	// Min and Max, if set, bound integer values, inclusive.
+	Min *int64
+	Max *int64
+
+	// Table, if set, is the schema of a table value.
+	Table Schema
+}
+
+// Validate checks that the table conforms to the schema, returning all the
+// violations, joined. Keys that are not in the schema are ignored.
+func (self Table) Validate(s Schema) error {
+	return errors.Join(validate_table(self, s, "")...)
+}
+
+func validate_table(t Table, s Schema, prefix string) []error {
+	var errs []error
+	// sorted, so that errors are reported in a stable order
+	for _, key := range slices.Sorted(maps.Keys(s)) {
+		spec := s[key]
+		name := prefix + key
+		v, ok := t.Get(key)
+		if !ok {
+			if spec.Required {
+				errs = append(errs, fmt.Errorf("key '%s': missing required key", name))
+			}
+			continue
+		}
+		errs = append(errs, validate_value(v, spec, name)...)
+	}
+	return errs
+}
+
+func validate_value(v Value, spec FieldSpec, name string) []error {
+	if spec.Kind != ValueKindUndefined && v.Kind != spec.Kind {
+		return []error{fmt.Errorf("key '%s': expected %s, got %s", name, spec.Kind, v.Kind)}
+	}
+	switch v.Kind {
+	case ValueKindInteger:
+		n, err := v.get_integer()
+		if err != nil {
+			// only above math.MaxInt64, so only a maximum can be violated
+			if spec.Max != nil {
+				return []error{fmt.Errorf("key '%s': %d is above maximum of %d", name, v.Data.Uint, *spec.Max)}
+			}
+			return nil
+		}
+		if spec.Min != nil && n < *spec.Min {
+			return []error{fmt.Errorf("key '%s': %d is below minimum of %d", name, n, *spec.Min)}
+		}
+		if spec.Max != nil && n > *spec.Max {
+			return []error{fmt.Errorf("key '%s': %d is above maximum of %d", name, n, *spec.Max)}
+		}
+	case ValueKindTable:
+		if spec.Table != nil {
+			return validate_table(v.Data.Table, spec.Table, name+".")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package kevs
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	minPort, maxPort := int64(1), int64(65535)
+
+	schema := Schema{
+		"name":  {Kind: ValueKindString, Required: true},
+		"debug": {Kind: ValueKindBoolean},
+		"server": {Kind: ValueKindTable, Required: true, Table: Schema{
+			"host": {Kind: ValueKindString, Required: true},
+			"port": {Kind: ValueKindInteger, Min: &minPort, Max: &maxPort},
+		}},
+		"tags":  {Kind: ValueKindList},
+		"extra": {},
+	}
+
+	root, err := Parse("none", `
+name = "app";
+server = { host = "localhost"; port = 8080; };
+tags = [];
+extra = 1;
+unknown = true;
+`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Validate(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err = Parse("none", `
+debug = "yes";
+server = { port = 0; };
+tags = {};
+`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var have []string
+	for _, e := range flatten_errors(root.Validate(schema)) {
+		have = append(have, e.Error())
+	}
+	want := []string{
+		"key 'debug': expected boolean, got string",
+		"key 'name': missing required key",
+		"key 'server.host': missing required key",
+		"key 'server.port': 0 is below minimum of 1",
+		"key 'tags': expected list, got table",
+	}
+	if !slices.Equal(have, want) {
+		t.Fatalf("want %q, have %q", want, have)
+	}
+
+	root, err = Parse("none", `name = "x"; server = { host = "h"; port = 18446744073709551615; };`, Flags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Validate(schema); err == nil {
+		t.Fatal("expected error for port above maximum")
+	}
+}
@@ -0,0 +1,151 @@
+package kevs
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ToYAML returns the table in a subset of YAML: keys followed by ':', list
+// items by '-' and nested values indented by two spaces. Strings are always
+// double quoted and keys only when YAML could read them as something else,
+// so that a YAML parser gets back the same values.
+func (self Table) ToYAML() ([]byte, error) {
+	var dst bytes.Buffer
+	if len(self) == 0 {
+		dst.WriteString("{}\n")
+		return dst.Bytes(), nil
+	}
+	if err := write_yaml_table(&dst, self, 0, false); err != nil {
+		return nil, err
+	}
+	return dst.Bytes(), nil
+}
+
+// write_yaml_table writes the key-values of t, one per line. If inline is
+// set, the first one continues the current line, e.g. after a '-'.
+func write_yaml_table(dst *bytes.Buffer, t Table, indent int, inline bool) error {
+	for i, kv := range t {
+		if i > 0 || !inline {
+			dst.WriteString(strings.Repeat(" ", indent))
+		}
+		dst.WriteString(yaml_key(kv.Key))
+		dst.WriteByte(':')
+		if err := write_yaml_value(dst, kv.Value, indent, false); err != nil {
+			return fmt.Errorf("key '%s': %w", kv.Key, err)
+		}
+	}
+	return nil
+}
+
+// write_yaml_list is like write_yaml_table, for the items of l.
+func write_yaml_list(dst *bytes.Buffer, l List, indent int, inline bool) error {
+	for i, item := range l {
+		if i > 0 || !inline {
+			dst.WriteString(strings.Repeat(" ", indent))
+		}
+		dst.WriteByte('-')
+		if err := write_yaml_value(dst, item, indent, true); err != nil {
+			return fmt.Errorf("element %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// write_yaml_value writes v after a key or a '-' at the given indent. The
+// items of a list, and the key-values of a table inside a list, continue
+// the line of their '-'.
+func write_yaml_value(dst *bytes.Buffer, v Value, indent int, item bool) error {
+	switch {
+	case v.Kind == ValueKindList && len(v.Data.List) != 0:
+		if item {
+			dst.WriteByte(' ')
+			return write_yaml_list(dst, v.Data.List, indent+2, true)
+		}
+		dst.WriteByte('\n')
+		return write_yaml_list(dst, v.Data.List, indent+2, false)
+
+	case v.Kind == ValueKindTable && len(v.Data.Table) != 0:
+		if item {
+			dst.WriteByte(' ')
+			return write_yaml_table(dst, v.Data.Table, indent+2, true)
+		}
+		dst.WriteByte('\n')
+		return write_yaml_table(dst, v.Data.Table, indent+2, false)
+	}
+
+	s, err := yaml_scalar(v)
+	if err != nil {
+		return err
+	}
+	dst.WriteByte(' ')
+	dst.WriteString(s)
+	dst.WriteByte('\n')
+	return nil
+}
+
+func yaml_scalar(v Value) (string, error) {
+	switch v.Kind {
+	case ValueKindString:
+		var dst bytes.Buffer
+		write_json_string(&dst, v.Data.String)
+		return dst.String(), nil
+
+	case ValueKindInteger:
+		return v.FormatInteger(10), nil
+
+	case ValueKindFloat:
+		f := v.Data.Float
+		switch {
+		case math.IsNaN(f):
+			return ".nan", nil
+		case math.IsInf(f, 1):
+			return ".inf", nil
+		case math.IsInf(f, -1):
+			return "-.inf", nil
+		}
+		// YAML 1.1 needs a dot in the mantissa, e.g. 1.0e+06
+		s := strconv.FormatFloat(f, 'g', -1, 64)
+		mantissa, exponent, _ := strings.Cut(s, "e")
+		if !strings.Contains(mantissa, ".") {
+			mantissa += ".0"
+		}
+		if exponent != "" {
+			return mantissa + "e" + exponent, nil
+		}
+		return mantissa, nil
+
+	case ValueKindBoolean:
+		return strconv.FormatBool(v.Data.Boolean), nil
+
+	case ValueKindNull:
+		return "null", nil
+
+	case ValueKindList:
+		return "[]", nil
+
+	case ValueKindTable:
+		return "{}", nil
+
+	default:
+		return "", fmt.Errorf("cannot encode value of kind %s", v.Kind)
+	}
+}
+
+// yaml_key quotes the keys that are not identifiers, or that YAML 1.1 reads
+// as booleans or null, e.g. on or no.
+func yaml_key(key string) string {
+	switch strings.ToLower(key) {
+	case "y", "n", "yes", "no", "on", "off", "true", "false", "null":
+		// quoted below
+	default:
+		if is_identifier(key) {
+			return key
+		}
+	}
+	var dst bytes.Buffer
+	write_json_string(&dst, key)
+	return dst.String()
+}
@@ -0,0 +1,77 @@
+package kevs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestToYAML(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{``, "{}\n"},
+		{
+			`name = "app: \"x\""; port = 8080; rate = 2.5e-3; big = 1e6; debug = true; none = null;`,
+			`name: "app: \"x\""
+port: 8080
+rate: 0.0025
+big: 1.0e+06
+debug: true
+none: null
+`,
+		},
+		{
+			`server = { host = "h"; tls = { cert = "c"; }; empty = {}; }; tags = [];`,
+			`server:
+  host: "h"
+  tls:
+    cert: "c"
+  empty: {}
+tags: []
+`,
+		},
+		{
+			`list = [ 1; "x"; { a = 1; b = [ 2; 3; ]; }; [ true; [ null; ]; ]; {}; ];`,
+			`list:
+  - 1
+  - "x"
+  - a: 1
+    b:
+      - 2
+      - 3
+  - - true
+    - - null
+  - {}
+`,
+		},
+	}
+	for _, test := range tests {
+		out, err := mustParse(t, test.in).ToYAML()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != test.out {
+			t.Errorf("want:\n%s\nhave:\n%s", test.out, out)
+		}
+	}
+
+	root := Table{
+		{Key: "on", Value: IntegerValue(1)},
+		{Key: "log-level", Value: IntegerValue(2)},
+		{Key: "inf", Value: FloatValue(math.Inf(-1))},
+		{Key: "nan", Value: FloatValue(math.NaN())},
+	}
+	out, err := root.ToYAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "\"on\": 1\n\"log-level\": 2\ninf: -.inf\nnan: .nan\n"
+	if string(out) != want {
+		t.Fatalf("want %q, have %q", want, out)
+	}
+
+	if _, err := (Table{{Key: "u", Value: Value{}}}).ToYAML(); err == nil {
+		t.Fatal("expected error")
+	}
+}